@@ -2,4 +2,4 @@ module pdftomd
 
 go 1.25.6
 
-require github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728 // indirect
+require github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728
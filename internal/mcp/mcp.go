@@ -0,0 +1,497 @@
+// Package mcp est le client Model Context Protocol des deux builds : serveurs d'outils externes en
+// stdio ou en streamable HTTP, dont les outils s'ajoutent au registre (internal/tool).
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"pdftomd/internal/shell"
+	"pdftomd/internal/tool"
+)
+
+const (
+	ProtocolVersion = "2025-06-18"
+	StartTimeout    = 30 * time.Second
+	CallTimeout     = 300 * time.Second
+	ResultMax       = 30000
+	ToolPrefix      = "mcp__"
+)
+
+// Server : entrée de mcp_servers dans .nanocode/config.json.
+type Server struct {
+	Command []string          `json:"command"` // stdio : ["npx", "-y", "@modelcontextprotocol/server-github"]
+	Env     map[string]string `json:"env"`     // ${VAR} remplacés depuis l'environnement
+	URL     string            `json:"url"`     // streamable HTTP : "http://localhost:8000/mcp"
+	Headers map[string]string `json:"headers"` // idem, ${VAR} remplacés
+}
+
+// Tool : un outil tel que le serveur le liste.
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// RPCError et Message : JSON-RPC 2.0, aussi utilisés par le serveur MCP de nanocode (nanocode mcp).
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Message struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// Client : connexion à un serveur. Err est l'échec de connexion ; le serveur est alors ignoré.
+type Client struct {
+	Name   string
+	Conf   Server
+	Err    error
+	notice func(string)
+
+	// stdio : cmd, in, stderr et dead sont remplacés quand le serveur est relancé
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	stderr  *shell.Buffer
+	writeMu sync.Mutex
+	dead    chan struct{}
+	connMu  sync.Mutex // une seule relance à la fois
+
+	// HTTP
+	client  *http.Client
+	session string // Mcp-Session-Id
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan Message
+	tools   []Tool
+	stale   bool // notifications/tools/list_changed reçu
+}
+
+// Set : les serveurs de la config, dans l'ordre de leur nom.
+type Set struct {
+	Clients []*Client
+}
+
+var nameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// ToolName : nom exposé au modèle, unique par serveur et limité à 64 caractères.
+func ToolName(server, tool string) string {
+	n := ToolPrefix + nameRe.ReplaceAllString(server, "_") + "__" + nameRe.ReplaceAllString(tool, "_")
+	if len(n) > 64 { n = n[:64] }
+	return n
+}
+
+// Start connecte les serveurs en parallèle ; notice reçoit les messages à afficher en cours de
+// session (relance d'un serveur arrêté).
+func Start(servers map[string]Server, notice func(msg string)) *Set {
+	s := &Set{}
+	var wg sync.WaitGroup
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		c := &Client{Name: name, Conf: servers[name], notice: notice, pending: map[int]chan Message{}}
+		s.Clients = append(s.Clients, c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), StartTimeout)
+			defer cancel()
+			if c.Err = c.connect(ctx); c.Err != nil { c.close() }
+		}()
+	}
+	wg.Wait()
+	return s
+}
+
+func (s *Set) Close() {
+	for _, c := range s.Clients {
+		if c.Err == nil { c.close() }
+	}
+}
+
+// Tools renvoie les outils de tous les serveurs pour le registre (relistés si le serveur l'a demandé).
+// Un seul appelant reliste ; en cas d'échec, l'ancienne liste reste jusqu'à la notification suivante.
+func (s *Set) Tools() []tool.Tool {
+	var out []tool.Tool
+	for _, c := range s.Clients {
+		if c.Err != nil { continue }
+		c.mu.Lock()
+		stale := c.stale
+		c.stale = false
+		c.mu.Unlock()
+		if stale {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			c.listTools(ctx)
+			cancel()
+		}
+		for _, t := range c.Listed() {
+			var schema map[string]interface{}
+			json.Unmarshal(t.InputSchema, &schema)
+			if schema == nil { schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}} }
+			desc := t.Description
+			if desc == "" { desc = t.Name }
+			out = append(out, &proxy{c: c, tool: t.Name, name: ToolName(c.Name, t.Name), desc: "[" + c.Name + "] " + desc, schema: schema})
+		}
+	}
+	return out
+}
+
+// Listed renvoie la dernière liste d'outils reçue du serveur.
+func (c *Client) Listed() []Tool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.tools)
+}
+
+// proxy expose un outil MCP tel quel : son schéma vient du serveur et c'est lui qui valide.
+type proxy struct {
+	c          *Client
+	tool       string // nom côté serveur
+	name, desc string
+	schema     map[string]interface{}
+}
+
+func (t *proxy) Name() string                       { return t.name }
+func (t *proxy) Description() string                { return t.desc }
+func (t *proxy) Parameters() map[string]interface{} { return t.schema }
+
+func (t *proxy) Execute(ctx context.Context, args map[string]interface{}) (string, error) {
+	return t.c.CallTool(ctx, t.tool, args)
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	switch {
+	case c.Conf.URL != "":
+		c.client = &http.Client{Timeout: CallTimeout}
+	case len(c.Conf.Command) > 0:
+		if err := c.startStdio(); err != nil { return err }
+	default:
+		return fmt.Errorf("needs a command or a url")
+	}
+	_, err := c.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]interface{}{"roots": map[string]bool{"listChanged": false}},
+		"clientInfo":      map[string]string{"name": "nanocode", "version": "7"},
+	})
+	if err != nil { return fmt.Errorf("initialize: %v", err) }
+	c.notify("notifications/initialized", nil)
+	return c.listTools(ctx)
+}
+
+func (c *Client) listTools(ctx context.Context) error {
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" { params["cursor"] = cursor }
+		raw, err := c.call(ctx, "tools/list", params)
+		if err != nil { return fmt.Errorf("tools/list: %v", err) }
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil { return fmt.Errorf("tools/list: %v", err) }
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" || page.NextCursor == cursor { break }
+		cursor = page.NextCursor
+	}
+	c.mu.Lock()
+	c.tools = tools // stale n'est pas touché : une notification reçue pendant la liste vaut pour la suivante
+	c.mu.Unlock()
+	return nil
+}
+
+// startStdio lance le serveur dans son propre groupe de processus : le Ctrl-C du terminal, qui
+// interrompt le tour en cours, ne doit pas le tuer.
+func (c *Client) startStdio() error {
+	cmd := exec.Command(c.Conf.Command[0], c.Conf.Command[1:]...)
+	shell.SetProcessGroup(cmd)
+	cmd.Env = os.Environ()
+	for k, v := range c.Conf.Env { cmd.Env = append(cmd.Env, k+"="+os.ExpandEnv(v)) }
+	stderr := shell.NewBuffer(4000)
+	cmd.Stderr = stderr
+	in, err := cmd.StdinPipe()
+	if err != nil { return err }
+	out, err := cmd.StdoutPipe()
+	if err != nil { return err }
+	if err := cmd.Start(); err != nil { return err }
+	dead := make(chan struct{})
+	c.writeMu.Lock()
+	c.in = in
+	c.writeMu.Unlock()
+	c.mu.Lock()
+	c.cmd, c.stderr, c.dead = cmd, stderr, dead
+	c.mu.Unlock()
+	go c.readLoop(out, cmd, dead)
+	return nil
+}
+
+// revive relance un serveur stdio qui s'est arrêté (plantage, kill) avant de l'appeler.
+func (c *Client) revive(ctx context.Context) error {
+	if c.client != nil { return nil }
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.mu.Lock()
+	dead := c.dead
+	c.mu.Unlock()
+	select {
+	case <-dead:
+	default:
+		return nil
+	}
+	if c.notice != nil { c.notice("MCP server " + c.Name + " exited, restarting") }
+	if err := c.connect(ctx); err != nil { return fmt.Errorf("restart %s: %v", c.Name, err) }
+	return nil
+}
+
+// readLoop lit les messages JSON-RPC (un par ligne) du serveur stdio.
+func (c *Client) readLoop(r io.Reader, cmd *exec.Cmd, dead chan struct{}) {
+	defer func() {
+		cmd.Wait()
+		close(dead)
+	}()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for sc.Scan() {
+		var msg Message
+		if json.Unmarshal(sc.Bytes(), &msg) != nil { continue }
+		c.handle(msg)
+	}
+}
+
+// handle traite un message reçu : réponse à un appel, notification ou requête du serveur.
+func (c *Client) handle(msg Message) {
+	switch {
+	case msg.Method == "notifications/tools/list_changed":
+		c.mu.Lock()
+		c.stale = true
+		c.mu.Unlock()
+	case msg.Method != "" && msg.ID != nil:
+		reply := map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID}
+		switch msg.Method {
+		case "ping":
+			reply["result"] = map[string]interface{}{}
+		case "roots/list":
+			cwd, _ := os.Getwd()
+			reply["result"] = map[string]interface{}{"roots": []map[string]string{{"uri": fileURI(cwd), "name": filepath.Base(cwd)}}}
+		default:
+			reply["error"] = RPCError{Code: -32601, Message: "method not supported by nanocode: " + msg.Method}
+		}
+		c.send(reply)
+	case msg.Method == "" && msg.ID != nil:
+		var id int
+		if json.Unmarshal(msg.ID, &id) != nil { return }
+		c.mu.Lock()
+		ch := c.pending[id]
+		c.mu.Unlock()
+		if ch != nil { ch <- msg }
+	}
+}
+
+func fileURI(abs string) string {
+	p := filepath.ToSlash(abs)
+	if !strings.HasPrefix(p, "/") { p = "/" + p } // C:/x -> /C:/x
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+func (c *Client) send(msg map[string]interface{}) error {
+	msg["jsonrpc"] = "2.0"
+	body, _ := json.Marshal(msg)
+	if c.client != nil {
+		resp, err := c.post(context.Background(), body)
+		if err != nil { return err }
+		resp.Body.Close()
+		return nil
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.in.Write(append(body, '\n'))
+	return err
+}
+
+func (c *Client) notify(method string, params interface{}) {
+	msg := map[string]interface{}{"method": method}
+	if params != nil { msg["params"] = params }
+	c.send(msg)
+}
+
+func (c *Client) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.mu.Unlock()
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+	var reply Message
+	if c.client != nil {
+		r, err := c.callHTTP(ctx, id, msg)
+		if err != nil { return nil, err }
+		reply = r
+	} else {
+		ch := make(chan Message, 1)
+		c.mu.Lock()
+		c.pending[id] = ch
+		dead, stderr := c.dead, c.stderr
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, id)
+			c.mu.Unlock()
+		}()
+		if err := c.send(msg); err != nil { return nil, err }
+		select {
+		case reply = <-ch:
+		case <-dead:
+			return nil, fmt.Errorf("server exited %s", strings.TrimSpace(stderr.String()))
+		case <-ctx.Done():
+			c.notify("notifications/cancelled", map[string]interface{}{"requestId": id, "reason": "interrupted"})
+			return nil, ctx.Err()
+		}
+	}
+	if reply.Error != nil { return nil, fmt.Errorf("%s (code %d)", reply.Error.Message, reply.Error.Code) }
+	return reply.Result, nil
+}
+
+func (c *Client) post(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Conf.URL, bytes.NewReader(body))
+	if err != nil { return nil, err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("MCP-Protocol-Version", ProtocolVersion)
+	c.mu.Lock()
+	if c.session != "" { req.Header.Set("Mcp-Session-Id", c.session) }
+	c.mu.Unlock()
+	for k, v := range c.Conf.Headers { req.Header.Set(k, os.ExpandEnv(v)) }
+	return c.client.Do(req)
+}
+
+// callHTTP envoie une requête en streamable HTTP ; la réponse arrive en JSON ou dans un flux SSE.
+func (c *Client) callHTTP(ctx context.Context, id int, msg map[string]interface{}) (Message, error) {
+	var reply Message
+	body, _ := json.Marshal(msg)
+	resp, err := c.post(ctx, body)
+	if err != nil { return reply, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return reply, fmt.Errorf("HTTP %s %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	if s := resp.Header.Get("Mcp-Session-Id"); s != "" {
+		c.mu.Lock()
+		c.session = s
+		c.mu.Unlock()
+	}
+	isReply := func(m Message) bool {
+		var got int
+		return m.Method == "" && json.Unmarshal(m.ID, &got) == nil && got == id
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil { return reply, err }
+		return reply, nil
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	var data strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		if v, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(v, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 { continue }
+		var m Message
+		if json.Unmarshal([]byte(data.String()), &m) == nil {
+			if isReply(m) { return m, nil }
+			c.handle(m)
+		}
+		data.Reset()
+	}
+	if data.Len() > 0 && json.Unmarshal([]byte(data.String()), &reply) == nil && isReply(reply) { return reply, nil }
+	if err := sc.Err(); err != nil { return reply, err }
+	return reply, fmt.Errorf("stream ended without a response")
+}
+
+func (c *Client) close() {
+	if c.client != nil {
+		if c.session != "" {
+			req, _ := http.NewRequest("DELETE", c.Conf.URL, nil)
+			req.Header.Set("Mcp-Session-Id", c.session)
+			for k, v := range c.Conf.Headers { req.Header.Set(k, os.ExpandEnv(v)) }
+			if resp, err := (&http.Client{Timeout: 2 * time.Second}).Do(req); err == nil { resp.Body.Close() }
+		}
+		return
+	}
+	if c.cmd == nil || c.cmd.Process == nil { return }
+	c.in.Close() // fin de stdin : arrêt propre prévu par le protocole
+	select {
+	case <-c.dead:
+	case <-time.After(2 * time.Second):
+		shell.KillProcessGroup(c.cmd)
+		<-c.dead
+	}
+}
+
+// CallTool appelle l'outil name du serveur (relancé s'il s'est arrêté) et renvoie son texte ; un
+// résultat isError devient une erreur.
+func (c *Client) CallTool(ctx context.Context, name string, args map[string]interface{}) (string, error) {
+	if args == nil { args = map[string]interface{}{} }
+	ctx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+	if err := c.revive(ctx); err != nil { return "", err }
+	raw, err := c.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": args})
+	if err != nil { return "", err }
+	var res struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			MimeType string `json:"mimeType"`
+			Data     string `json:"data"`
+			URI      string `json:"uri"`
+			Resource struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+		StructuredContent json.RawMessage `json:"structuredContent"`
+		IsError           bool            `json:"isError"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil { return "", err }
+	var parts []string
+	for _, p := range res.Content {
+		switch p.Type {
+		case "text":
+			parts = append(parts, p.Text)
+		case "resource":
+			if p.Resource.Text != "" { parts = append(parts, p.Resource.Text) } else { parts = append(parts, "[resource "+p.Resource.URI+"]") }
+		case "resource_link":
+			parts = append(parts, "[resource "+p.URI+"]")
+		default: // image, audio : pas affichables ici
+			parts = append(parts, fmt.Sprintf("[%s %s, %d bytes base64]", p.Type, p.MimeType, len(p.Data)))
+		}
+	}
+	if len(parts) == 0 && len(res.StructuredContent) > 0 { parts = append(parts, string(res.StructuredContent)) }
+	out := strings.Join(parts, "\n")
+	if len(out) > ResultMax { out = out[:ResultMax] + "\n...[TRUNCATED]..." }
+	if res.IsError { return "", errors.New(out) }
+	if out == "" { return "(no output)", nil }
+	return out, nil
+}
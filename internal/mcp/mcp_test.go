@@ -0,0 +1,151 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Le binaire de test sert aussi de serveur MCP stdio (MCP_FAKE_SERVER=1).
+func TestMain(m *testing.M) {
+	if os.Getenv("MCP_FAKE_SERVER") != "" { fakeServer(); return }
+	os.Exit(m.Run())
+}
+
+// reply répond à un message du client ; notify indique une notification list_changed à envoyer ensuite.
+func reply(extra *bool, msg Message) (result interface{}, notify bool) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{"protocolVersion": ProtocolVersion, "capabilities": map[string]interface{}{"tools": map[string]bool{"listChanged": true}}}, false
+	case "tools/list":
+		tools := []map[string]interface{}{{"name": "echo", "description": "Echo args", "inputSchema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"s": map[string]string{"type": "string"}}}}}
+		if *extra { tools = append(tools, map[string]interface{}{"name": "late.tool"}) }
+		return map[string]interface{}{"tools": tools}, false
+	case "tools/call":
+		var p struct {
+			Name      string                 `json:"name"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		json.Unmarshal(msg.Params, &p)
+		switch p.Name {
+		case "add":
+			*extra = true
+			return map[string]interface{}{"content": []map[string]string{{"type": "text", "text": "added"}}}, true
+		case "fail":
+			return map[string]interface{}{"content": []map[string]string{{"type": "text", "text": "boom"}}, "isError": true}, false
+		case "exit":
+			os.Exit(1)
+		}
+		args, _ := json.Marshal(p.Arguments)
+		return map[string]interface{}{"content": []map[string]string{{"type": "text", "text": p.Name + " " + string(args)}}}, false
+	}
+	return nil, false
+}
+
+func fakeServer() {
+	extra := false
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		var msg Message
+		if json.Unmarshal(sc.Bytes(), &msg) != nil || msg.ID == nil { continue }
+		res, notify := reply(&extra, msg)
+		out, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": res})
+		fmt.Println(string(out))
+		if notify { fmt.Println(`{"jsonrpc":"2.0","method":"notifications/tools/list_changed"}`) }
+	}
+}
+
+func TestToolName(t *testing.T) {
+	for _, c := range []struct{ server, tool, want string }{
+		{"github", "create_issue", "mcp__github__create_issue"},
+		{"my server", "a.b/c", "mcp__my_server__a_b_c"},
+		{"s", strings.Repeat("x", 80), ("mcp__s__" + strings.Repeat("x", 80))[:64]},
+	} {
+		if got := ToolName(c.server, c.tool); got != c.want { t.Errorf("ToolName(%q, %q) = %q, want %q", c.server, c.tool, got, c.want) }
+	}
+}
+
+func names(s *Set) []string {
+	var out []string
+	for _, t := range s.Tools() { out = append(out, t.Name()) }
+	return out
+}
+
+func isStale(c *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stale
+}
+
+func TestStdio(t *testing.T) {
+	var notices []string
+	s := Start(map[string]Server{"fake": {Command: []string{os.Args[0]}, Env: map[string]string{"MCP_FAKE_SERVER": "1"}}}, func(msg string) { notices = append(notices, msg) })
+	defer s.Close()
+	if err := s.Clients[0].Err; err != nil { t.Fatal(err) }
+	if got := names(s); strings.Join(got, ",") != "mcp__fake__echo" { t.Fatalf("Tools = %v", got) }
+
+	ctx := context.Background()
+	echo := s.Tools()[0]
+	if out, err := echo.Execute(ctx, map[string]interface{}{"s": "hi"}); out != `echo {"s":"hi"}` || err != nil { t.Errorf("echo = %q, %v", out, err) }
+	c := s.Clients[0]
+	if _, err := c.CallTool(ctx, "fail", nil); err == nil || err.Error() != "boom" { t.Errorf("fail: error = %v", err) }
+
+	// list_changed : la liste suivante reprend les outils du serveur
+	if out, err := c.CallTool(ctx, "add", nil); out != "added" || err != nil { t.Fatalf("add = %q, %v", out, err) }
+	for i := 0; i < 100 && !isStale(c); i++ { time.Sleep(10 * time.Millisecond) } // la notification suit la réponse
+	if got := names(s); strings.Join(got, ",") != "mcp__fake__echo,mcp__fake__late_tool" { t.Errorf("Tools after list_changed = %v", got) }
+
+	// serveur arrêté : l'appel suivant le relance
+	if _, err := c.CallTool(ctx, "exit", nil); err == nil || !strings.Contains(err.Error(), "server exited") { t.Errorf("exit: error = %v", err) }
+	if out, err := echo.Execute(ctx, nil); out != "echo {}" || err != nil { t.Errorf("echo after restart = %q, %v", out, err) }
+	if len(notices) != 1 || !strings.Contains(notices[0], "restarting") { t.Errorf("notices = %v", notices) }
+}
+
+func TestHTTP(t *testing.T) {
+	extra := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" { return }
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		if msg.ID == nil { w.WriteHeader(http.StatusAccepted); return }
+		res, notify := reply(&extra, msg)
+		out, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": res})
+		w.Header().Set("Mcp-Session-Id", "sess")
+		if msg.Method != "tools/call" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(out)
+			return
+		}
+		// réponse en SSE, précédée de la notification
+		w.Header().Set("Content-Type", "text/event-stream")
+		if notify { fmt.Fprint(w, "data: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/tools/list_changed\"}\n\n") }
+		fmt.Fprintf(w, "data: %s\n\n", out)
+	}))
+	defer srv.Close()
+
+	s := Start(map[string]Server{"web": {URL: srv.URL}}, nil)
+	defer s.Close()
+	if err := s.Clients[0].Err; err != nil { t.Fatal(err) }
+	if got := names(s); strings.Join(got, ",") != "mcp__web__echo" { t.Fatalf("Tools = %v", got) }
+	c := s.Clients[0]
+	if out, err := c.CallTool(context.Background(), "add", nil); out != "added" || err != nil { t.Fatalf("add = %q, %v", out, err) }
+	if got := names(s); len(got) != 2 { t.Errorf("Tools after list_changed = %v", got) }
+	if c.session != "sess" { t.Errorf("session = %q", c.session) }
+}
+
+func TestStartError(t *testing.T) {
+	s := Start(map[string]Server{"b": {}, "a": {Command: []string{"/nonexistent/mcp-server"}}}, nil)
+	if len(s.Clients) != 2 || s.Clients[0].Name != "a" { t.Fatalf("Clients = %v", s.Clients) }
+	for _, c := range s.Clients {
+		if c.Err == nil { t.Errorf("%s: no error", c.Name) }
+	}
+	if tools := s.Tools(); len(tools) != 0 { t.Errorf("Tools = %v", tools) }
+	s.Close()
+}
@@ -0,0 +1,114 @@
+// Package mention joint au message de l'utilisateur le contenu des @fichier, @dossier et @fichier:10-40
+// qu'il cite.
+package mention
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pdftomd/internal/textfile"
+)
+
+// MaxBytes : taille maximale du contenu joint pour une mention.
+const MaxBytes = 20000
+
+var mentionRe = regexp.MustCompile(`(^|\s)@([^\s]+)`)
+var rangeRe = regexp.MustCompile(`^(.+):(\d+)(?:-(\d+))?$`)
+
+// Expand renvoie input suivi du contenu des mentions qu'il cite ; attached est appelé pour chacune.
+// Une mention qui ne correspond à rien de lisible sur le disque est laissée telle quelle.
+func Expand(input string, attached func(ref string)) string {
+	var attachments []string
+	seen := map[string]bool{}
+	for _, m := range mentionRe.FindAllStringSubmatch(input, -1) {
+		// "@main.go," : on essaie tel quel, puis sans la ponctuation finale
+		for _, ref := range []string{m[2], strings.TrimRight(m[2], ".,;:!?)\"'")} {
+			if ref == "" || seen[ref] { continue }
+			if a, ok := Read(ref); ok {
+				seen[ref] = true
+				attachments = append(attachments, a)
+				if attached != nil { attached(ref) }
+				break
+			}
+		}
+	}
+	if len(attachments) == 0 { return input }
+	return input + "\n\n" + strings.Join(attachments, "\n\n")
+}
+
+// Read renvoie le bloc joint pour une mention, ou false si elle ne désigne rien de lisible : fichier ou
+// dossier absent, plage qui commence après la fin du fichier. Un fichier binaire est signalé sans son
+// contenu ; un texte trop long est coupé à MaxBytes.
+func Read(ref string) (string, bool) {
+	path, ranged, from, to := ref, false, 0, 0
+	if _, err := os.Stat(path); err != nil {
+		m := rangeRe.FindStringSubmatch(ref)
+		if m == nil { return "", false }
+		path, ranged = m[1], true
+		from, _ = strconv.Atoi(m[2])
+		to = from
+		if m[3] != "" { to, _ = strconv.Atoi(m[3]) }
+		if to < from { from, to = to, from }
+		if from < 1 { from = 1 } // "@f:0" ou "@f:3-0" : à partir de la première ligne
+		if to < from { to = from }
+	}
+	info, err := os.Stat(path)
+	if err != nil { return "", false }
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil { return "", false }
+		var sb strings.Builder
+		for _, en := range entries {
+			name := en.Name()
+			if en.IsDir() { name += "/" }
+			sb.WriteString(name + "\n")
+		}
+		return fmt.Sprintf("<directory path=%q>\n%s</directory>", path, sb.String()), true
+	}
+
+	head, cut, err := textfile.ReadHead(path, MaxBytes)
+	if err != nil { return "", false }
+	attr := fmt.Sprintf("path=%q", path)
+	if textfile.IsBinary(head) { return fmt.Sprintf("<file %s>\n(binary file, not attached)\n</file>", attr), true }
+
+	text := string(head)
+	if ranged {
+		if text, to, cut, err = readLines(path, from, to); err != nil { return "", false }
+		attr += fmt.Sprintf(" lines=\"%d-%d\"", from, to)
+	}
+	if cut { text += "\n...[TRUNCATED]..." }
+	return fmt.Sprintf("<file %s>\n%s\n</file>", attr, strings.TrimRight(text, "\n")), true
+}
+
+// readLines lit les lignes from à to (numérotées à partir de 1) sans charger le reste du fichier ; last est
+// la dernière ligne lue. Erreur si le fichier a moins de from lignes.
+func readLines(path string, from, to int) (text string, last int, cut bool, err error) {
+	f, err := os.Open(path)
+	if err != nil { return "", 0, false, err }
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var sb strings.Builder
+	n := 0
+	for n < to {
+		line, err := r.ReadString('\n')
+		if line == "" && err != nil { break }
+		n++
+		if n < from { continue }
+		entry := fmt.Sprintf("%4d| %s\n", n, strings.TrimSuffix(line, "\n"))
+		if sb.Len()+len(entry) > MaxBytes {
+			// la dernière ligne est coupée ; un caractère coupé est retiré
+			sb.WriteString(strings.ToValidUTF8(entry[:MaxBytes-sb.Len()], ""))
+			return sb.String(), n, true, nil
+		}
+		sb.WriteString(entry)
+		if err == io.EOF { break }
+	}
+	if n < from { return "", 0, false, fmt.Errorf("%s: %d lines", path, n) }
+	return sb.String(), n, false, nil
+}
@@ -0,0 +1,77 @@
+package mention
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.WriteFile("five.txt", []byte("l1\nl2\nl3\nl4\nl5\n"), 0644)
+	os.WriteFile("bin.dat", []byte("ELF\x00\x01\x02"), 0644)
+	os.WriteFile("big.log", []byte(strings.Repeat("0123456789\n", 3000)), 0644)
+	os.WriteFile("long.txt", []byte(strings.Repeat("x", 3*MaxBytes)), 0644)
+	os.Mkdir("sub", 0755)
+	os.WriteFile("sub/a.go", nil, 0644)
+
+	for _, c := range []struct {
+		ref   string
+		ok    bool
+		has   []string
+		hasnt []string
+	}{
+		{"five.txt", true, []string{`<file path="five.txt">`, "l1\nl2", "l5\n</file>"}, []string{"TRUNCATED"}},
+		{"five.txt:2-3", true, []string{`lines="2-3"`, "   2| l2\n   3| l3\n</file>"}, []string{"l1", "l4"}},
+		{"five.txt:4", true, []string{`lines="4-4"`, "   4| l4"}, []string{"l3", "l5"}},
+		{"five.txt:3-0", true, []string{`lines="1-3"`, "   1| l1", "   3| l3"}, []string{"l4"}},
+		{"five.txt:0", true, []string{`lines="1-1"`, "   1| l1"}, []string{"l2"}},
+		{"five.txt:0-0", true, []string{`lines="1-1"`}, nil},
+		{"five.txt:4-99", true, []string{`lines="4-5"`, "   5| l5"}, []string{"l3"}},
+		{"five.txt:5-2", true, []string{`lines="2-5"`}, []string{"l1"}},
+		{"five.txt:6", false, nil, nil},
+		{"five.txt:9-12", false, nil, nil},
+		{"missing.txt", false, nil, nil},
+		{"missing.txt:1-2", false, nil, nil},
+		{"bin.dat", true, []string{"binary file, not attached"}, []string{"ELF"}},
+		{"bin.dat:1-2", true, []string{"binary file, not attached"}, []string{"ELF"}},
+		{"big.log", true, []string{"...[TRUNCATED]..."}, nil},
+		{"big.log:1-3000", true, []string{"...[TRUNCATED]...", "   1| 0123456789"}, []string{"3000|"}},
+		{"long.txt:1", true, []string{`lines="1-1"`, "...[TRUNCATED]..."}, nil},
+		{"sub", true, []string{`<directory path="sub">`, "a.go\n"}, nil},
+	} {
+		got, ok := Read(c.ref)
+		if ok != c.ok { t.Errorf("Read(%q) ok = %v, want %v", c.ref, ok, c.ok); continue }
+		if len(got) > MaxBytes+200 { t.Errorf("Read(%q): %d bytes, over the cap", c.ref, len(got)) }
+		for _, s := range c.has {
+			if !strings.Contains(got, s) { t.Errorf("Read(%q) = %q, missing %q", c.ref, got, s) }
+		}
+		for _, s := range c.hasnt {
+			if strings.Contains(got, s) { t.Errorf("Read(%q) = %q, contains %q", c.ref, got, s) }
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.WriteFile("a.txt", []byte("alpha\n"), 0644)
+
+	for _, c := range []struct {
+		input    string
+		attached []string
+	}{
+		{"no mention", nil},
+		{"look at @a.txt", []string{"a.txt"}},
+		{"look at @a.txt, please", []string{"a.txt"}}, // ponctuation finale
+		{"@a.txt and @a.txt again", []string{"a.txt"}},
+		{"user@a.txt is an address", nil},
+		{"@missing.txt stays", nil},
+		{"@a.txt:3-0 reversed", []string{"a.txt:3-0"}},
+	} {
+		var attached []string
+		got := Expand(c.input, func(ref string) { attached = append(attached, ref) })
+		if strings.Join(attached, ",") != strings.Join(c.attached, ",") { t.Errorf("Expand(%q) attached %v, want %v", c.input, attached, c.attached) }
+		if !strings.HasPrefix(got, c.input) { t.Errorf("Expand(%q) = %q, input not kept", c.input, got) }
+		if n := strings.Count(got, "<file "); n != len(c.attached) { t.Errorf("Expand(%q): %d attachments, want %d", c.input, n, len(c.attached)) }
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package shell
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// DieWithParent demande au noyau de tuer la commande si nanocode meurt sans avoir fait le ménage
+// (SIGKILL, panique dans une goroutine).
+func DieWithParent(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil { cmd.SysProcAttr = &syscall.SysProcAttr{} }
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
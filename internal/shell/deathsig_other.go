@@ -0,0 +1,8 @@
+//go:build !linux
+
+package shell
+
+import "os/exec"
+
+// DieWithParent : seul Linux sait lier la vie d'un processus à celle de son parent.
+func DieWithParent(cmd *exec.Cmd) {}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package shell
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup met la commande dans son propre groupe pour pouvoir tuer ses enfants
+// aussi, et pour qu'un Ctrl-C du terminal ne l'atteigne pas.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil { cmd.SysProcAttr = &syscall.SysProcAttr{} }
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// KillProcessGroup tue le groupe entier ; à défaut (groupe déjà parti), le processus seul.
+func KillProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil { return nil }
+	if syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) == nil { return nil }
+	return cmd.Process.Kill()
+}
+
+// InterruptProcessGroup envoie SIGINT à tout le groupe, comme un Ctrl-C au terminal.
+func InterruptProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil { return nil }
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
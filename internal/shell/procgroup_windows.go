@@ -0,0 +1,22 @@
+//go:build windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+)
+
+// SetProcessGroup : pas de groupe de processus à la Unix sous Windows.
+func SetProcessGroup(cmd *exec.Cmd) {}
+
+func KillProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil { return nil }
+	return cmd.Process.Kill()
+}
+
+// InterruptProcessGroup : Windows ne sait pas envoyer d'interruption à un autre processus.
+func InterruptProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil { return nil }
+	return cmd.Process.Signal(os.Interrupt)
+}
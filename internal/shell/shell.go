@@ -0,0 +1,117 @@
+// Package shell regroupe ce qui sert à lancer des commandes dans les deux binaires nanocode :
+// résultat formaté pour le modèle, tampon de sortie borné, groupe de processus tué d'un bloc.
+package shell
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout = 120 * time.Second
+	MaxTimeout     = 600 * time.Second
+	OutputCap      = 30000 // octets gardés (moitié début, moitié fin)
+)
+
+type Result struct {
+	ExitCode    int
+	TimedOut    bool
+	Interrupted bool
+	Duration    time.Duration
+	Output      string
+	Dropped     int
+}
+
+func (r Result) String() string {
+	status := fmt.Sprintf("[exit_code=%d duration=%.1fs", r.ExitCode, r.Duration.Seconds())
+	if r.TimedOut { status += " timed_out=true" }
+	if r.Interrupted { status += " interrupted=true" }
+	if r.Dropped > 0 { status += fmt.Sprintf(" truncated=%dB", r.Dropped) }
+	status += "]"
+	if r.Output == "" { return status + "\n(no output)" }
+	return status + "\n" + r.Output
+}
+
+// Buffer garde le début et la fin de la sortie, le milieu est jeté.
+type Buffer struct {
+	mu      sync.Mutex
+	limit   int
+	head    []byte
+	tail    []byte
+	dropped int
+}
+
+func NewBuffer(limit int) *Buffer { return &Buffer{limit: limit} }
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	half := b.limit / 2
+	if room := half - len(b.head); room > 0 {
+		if room > len(p) { room = len(p) }
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	b.tail = append(b.tail, p...)
+	if over := len(b.tail) - (b.limit - half); over > 0 {
+		b.tail = append(b.tail[:0], b.tail[over:]...)
+		b.dropped += over
+	}
+	return n, nil
+}
+
+func (b *Buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dropped == 0 { return string(b.head) + string(b.tail) }
+	return fmt.Sprintf("%s\n...[%d bytes truncated]...\n%s", b.head, b.dropped, b.tail)
+}
+
+// Dropped : octets jetés au milieu de la sortie.
+func (b *Buffer) Dropped() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Prepare règle une commande créée avec exec.CommandContext : son propre groupe de processus, tué en
+// entier quand le contexte est annulé, et Wait qui n'attend pas un petit-enfant gardant le pipe ouvert.
+func Prepare(cmd *exec.Cmd) {
+	SetProcessGroup(cmd)
+	cmd.Cancel = func() error { return KillProcessGroup(cmd) }
+	cmd.WaitDelay = 2 * time.Second
+}
+
+// Run lance la commande que build prépare avec le contexte borné par timeout. live (optionnel)
+// reçoit la sortie en direct ; annuler parent tue tout le groupe de processus.
+func Run(parent context.Context, timeout time.Duration, live io.Writer, build func(ctx context.Context) (*exec.Cmd, error)) Result {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	cmd, err := build(ctx)
+	if err != nil { return Result{ExitCode: -1, Output: "Error: " + err.Error()} }
+	Prepare(cmd)
+	out := NewBuffer(OutputCap)
+	var w io.Writer = out
+	if live != nil { w = io.MultiWriter(out, live) }
+	cmd.Stdout = w; cmd.Stderr = w
+
+	start := time.Now()
+	err = cmd.Run()
+	res := Result{Duration: time.Since(start), Output: strings.TrimSpace(out.String()), Dropped: out.Dropped()}
+	res.Interrupted = parent.Err() != nil
+	res.TimedOut = !res.Interrupted && ctx.Err() == context.DeadlineExceeded
+	switch {
+	case cmd.ProcessState != nil:
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	case err != nil:
+		res.ExitCode = -1
+		res.Output = strings.TrimSpace("Error: " + err.Error() + "\n" + res.Output)
+	}
+	return res
+}
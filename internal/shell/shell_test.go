@@ -0,0 +1,71 @@
+package shell
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bash(cmdStr string) func(context.Context) (*exec.Cmd, error) {
+	return func(ctx context.Context) (*exec.Cmd, error) { return exec.CommandContext(ctx, "bash", "-c", cmdStr), nil }
+}
+
+func TestBuffer(t *testing.T) {
+	for _, c := range []struct {
+		limit   int
+		writes  []string
+		want    string
+		dropped int
+	}{
+		{10, []string{"abc"}, "abc", 0},
+		{10, []string{"0123456789"}, "0123456789", 0},
+		{10, []string{"0123456789AB"}, "01234\n...[2 bytes truncated]...\n789AB", 2},
+		{10, []string{"012", "34567", "89ABCD"}, "01234\n...[4 bytes truncated]...\n9ABCD", 4},
+	} {
+		b := NewBuffer(c.limit)
+		for _, w := range c.writes { b.Write([]byte(w)) }
+		if got := b.String(); got != c.want || b.Dropped() != c.dropped {
+			t.Errorf("%q: got %q (%d dropped), want %q (%d)", c.writes, got, b.Dropped(), c.want, c.dropped)
+		}
+	}
+}
+
+func TestResultString(t *testing.T) {
+	for _, c := range []struct {
+		r    Result
+		want string
+	}{
+		{Result{Duration: 40 * time.Millisecond}, "[exit_code=0 duration=0.0s]\n(no output)"},
+		{Result{ExitCode: 2, Duration: 1500 * time.Millisecond, Output: "boom"}, "[exit_code=2 duration=1.5s]\nboom"},
+		{Result{ExitCode: -1, TimedOut: true, Dropped: 10, Output: "x"}, "[exit_code=-1 duration=0.0s timed_out=true truncated=10B]\nx"},
+		{Result{ExitCode: 130, Interrupted: true}, "[exit_code=130 duration=0.0s interrupted=true]\n(no output)"},
+	} {
+		if got := c.r.String(); got != c.want { t.Errorf("%+v: got %q, want %q", c.r, got, c.want) }
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" { t.Skip("needs bash") }
+	if r := Run(context.Background(), time.Minute, nil, bash("echo out; echo err >&2; exit 3")); r.ExitCode != 3 || r.Output != "out\nerr" {
+		t.Errorf("exit: %+v", r)
+	}
+	if r := Run(context.Background(), time.Minute, nil, bash("true")); r.ExitCode != 0 || r.Output != "" || r.TimedOut || r.Interrupted {
+		t.Errorf("true: %+v", r)
+	}
+
+	// Le délai tue aussi le petit-enfant qui garde la sortie ouverte.
+	start := time.Now()
+	r := Run(context.Background(), 200*time.Millisecond, nil, bash("sleep 30 & sleep 30"))
+	if !r.TimedOut || r.Interrupted || time.Since(start) > 5*time.Second { t.Errorf("timeout: %+v after %v", r, time.Since(start)) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	if r := Run(ctx, time.Minute, nil, bash("sleep 30")); !r.Interrupted || r.TimedOut { t.Errorf("interrupt: %+v", r) }
+
+	if r := Run(context.Background(), time.Minute, nil, func(context.Context) (*exec.Cmd, error) { return nil, exec.ErrNotFound }); r.ExitCode != -1 || !strings.HasPrefix(r.Output, "Error: ") {
+		t.Errorf("build error: %+v", r)
+	}
+}
@@ -0,0 +1,33 @@
+// Package textfile reconnaît les fichiers texte et n'en lit que le début, pour ne jamais charger en
+// entier un gros journal ou un binaire avant de le couper.
+package textfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// IsBinary : octet nul ou UTF-8 invalide dans les 8000 premiers octets.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 { data = trimRune(data[:8000]) } // un caractère coupé par la troncature ne compte pas
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
+
+// ReadHead lit au plus limit octets de path ; cut indique que le fichier continue au-delà. Un caractère
+// coupé en fin de lecture est retiré.
+func ReadHead(path string, limit int) (data []byte, cut bool, err error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, false, err }
+	defer f.Close()
+	data, err = io.ReadAll(io.LimitReader(f, int64(limit)+1))
+	if err != nil { return nil, false, err }
+	if len(data) > limit { return trimRune(data[:limit]), true, nil }
+	return data, false, nil
+}
+
+func trimRune(data []byte) []byte {
+	for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(data); i++ { data = data[:len(data)-1] }
+	return data
+}
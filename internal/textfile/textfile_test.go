@@ -0,0 +1,43 @@
+package textfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsBinary(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want bool
+	}{
+		{"", false},
+		{"hello\n", false},
+		{"été 日本", false},
+		{"a\x00b", true},
+		{"\xff\xfe", true},
+		{strings.Repeat("a", 7999) + "é", false}, // é coupé à 8000 octets
+	} {
+		if got := IsBinary([]byte(c.data)); got != c.want { t.Errorf("IsBinary(%.20q) = %v", c.data, got) }
+	}
+}
+
+func TestReadHead(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(p, []byte("abcé"), 0644) // 5 octets
+	for _, c := range []struct {
+		limit int
+		want  string
+		cut   bool
+	}{
+		{10, "abcé", false},
+		{5, "abcé", false},
+		{4, "abc", true}, // é coupé : retiré
+		{2, "ab", true},
+	} {
+		data, cut, err := ReadHead(p, c.limit)
+		if err != nil || string(data) != c.want || cut != c.cut { t.Errorf("ReadHead(%d) = %q, %v, %v", c.limit, data, cut, err) }
+	}
+	if _, _, err := ReadHead(filepath.Join(t.TempDir(), "missing"), 10); err == nil { t.Error("missing file: no error") }
+}
@@ -0,0 +1,275 @@
+// Package tool décrit les outils proposés au modèle : un registre unique, d'où sortent les schémas au
+// format OpenAI (Mistral) ou Gemini, et le décodage typé des arguments avec des erreurs lisibles.
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Tool est un outil proposé au modèle. Les schémas propres à chaque fournisseur sont dérivés de Parameters.
+type Tool interface {
+	Name() string
+	Description() string
+	Parameters() map[string]interface{} // JSON Schema (type object)
+	// Execute renvoie le résultat pour le modèle, ou une erreur si l'appel a échoué : l'appelant la
+	// formate ("Error: ...") et la signale comme telle (isError côté MCP).
+	Execute(ctx context.Context, args map[string]interface{}) (string, error)
+}
+
+// typedTool (créé par New) décode et valide les arguments dans A avant d'appeler run ; le schéma vient des tags de A
+// (json pour le nom, omitempty = facultatif, desc et enum="a,b" en option).
+type typedTool[A any] struct {
+	name, desc string
+	schema     map[string]interface{}
+	run        func(context.Context, A) (string, error)
+}
+
+func New[A any](name, desc string, run func(context.Context, A) (string, error)) Tool {
+	return &typedTool[A]{name: name, desc: desc, schema: schemaOf(reflect.TypeFor[A]()), run: run}
+}
+
+func (t *typedTool[A]) Name() string                       { return t.name }
+func (t *typedTool[A]) Description() string                { return t.desc }
+func (t *typedTool[A]) Parameters() map[string]interface{} { return t.schema }
+
+func (t *typedTool[A]) Execute(ctx context.Context, args map[string]interface{}) (string, error) {
+	if args == nil { args = map[string]interface{}{} }
+	if err := Validate(t.schema, args); err != nil { return "", fmt.Errorf("invalid arguments for %s: %v", t.name, err) }
+	var a A
+	b, _ := json.Marshal(args)
+	if err := json.Unmarshal(b, &a); err != nil { return "", fmt.Errorf("invalid arguments for %s: %v", t.name, err) }
+	return t.run(ctx, a)
+}
+
+// schemaOf construit le JSON Schema d'un type Go (structs, slices, maps, scalaires).
+func schemaOf(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		required := []string{}
+		var walk func(t reflect.Type)
+		walk = func(t reflect.Type) {
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.Anonymous && f.Type.Kind() == reflect.Struct { walk(f.Type); continue }
+				if !f.IsExported() { continue }
+				name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+				if name == "-" { continue }
+				if name == "" { name = f.Name }
+				p := schemaOf(f.Type)
+				if d := f.Tag.Get("desc"); d != "" { p["description"] = d }
+				if e := f.Tag.Get("enum"); e != "" { p["enum"] = strings.Split(e, ",") }
+				props[name] = p
+				if !strings.Contains(opts, "omitempty") { required = append(required, name) }
+			}
+		}
+		walk(t)
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 { s["required"] = required }
+		return s
+	}
+	return map[string]interface{}{} // interface{} : n'importe quoi
+}
+
+// Validate vérifie les arguments d'un appel contre le schéma d'un outil ; l'erreur est faite pour
+// être renvoyée telle quelle au modèle.
+func Validate(schema map[string]interface{}, args map[string]interface{}) error {
+	return validateArgs(schema, args, "")
+}
+
+// validateArgs vérifie v contre le sous-ensemble de JSON Schema produit par schemaOf. Les erreurs
+// sont renvoyées au modèle, elles doivent lui dire quoi corriger.
+func validateArgs(schema map[string]interface{}, v interface{}, at string) error {
+	field := func(k string) string {
+		if at == "" { return k }
+		return at + "." + k
+	}
+	where := at
+	if where == "" { where = "arguments" }
+	typ, _ := schema["type"].(string)
+	switch typ {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok { return fmt.Errorf("%s must be an object, got %s", where, jsonType(v)) }
+		props, _ := schema["properties"].(map[string]interface{})
+		for _, k := range toStrings(schema["required"]) {
+			if obj[k] == nil { return fmt.Errorf("missing required %q", field(k)) }
+		}
+		extra, _ := schema["additionalProperties"].(map[string]interface{})
+		for _, k := range slices.Sorted(maps.Keys(obj)) {
+			if obj[k] == nil { continue } // null = absent
+			if p, ok := props[k].(map[string]interface{}); ok {
+				if err := validateArgs(p, obj[k], field(k)); err != nil { return err }
+			} else if extra != nil {
+				if err := validateArgs(extra, obj[k], field(k)); err != nil { return err }
+			} else if props != nil {
+				return fmt.Errorf("unknown argument %q (expected one of: %s)", field(k), strings.Join(slices.Sorted(maps.Keys(props)), ", "))
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok { return fmt.Errorf("%s must be an array, got %s", where, jsonType(v)) }
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, e := range arr {
+				if err := validateArgs(items, e, fmt.Sprintf("%s[%d]", where, i)); err != nil { return err }
+			}
+		}
+	case "string", "boolean", "number", "integer":
+		got := jsonType(v)
+		if got != typ && !(typ == "number" && got == "integer") { return fmt.Errorf("%s must be %s %s, got %s", where, article(typ), typ, got) }
+	}
+	if enum := toStrings(schema["enum"]); len(enum) > 0 {
+		if s, _ := v.(string); !slices.Contains(enum, s) { return fmt.Errorf("%s must be one of: %s", where, strings.Join(enum, ", ")) }
+	}
+	return nil
+}
+
+// jsonType : nom JSON Schema du type d'une valeur décodée par encoding/json.
+func jsonType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) { return "integer" }
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func article(typ string) string {
+	if strings.ContainsRune("aeiou", rune(typ[0])) { return "an" }
+	return "a"
+}
+
+// toStrings accepte []string (schémas Go) comme []interface{} (schémas décodés du JSON, MCP).
+func toStrings(v interface{}) []string {
+	switch x := v.(type) {
+	case []string:
+		return x
+	case []interface{}:
+		var out []string
+		for _, e := range x {
+			if s, ok := e.(string); ok { out = append(out, s) }
+		}
+		return out
+	}
+	return nil
+}
+
+// Registry liste les outils dans l'ordre d'enregistrement ; les sources ajoutent des outils
+// calculés à chaque appel (MCP, dont la liste peut changer en cours de session). Une source peut
+// coûter un aller-retour réseau : pendant un tour du modèle, on passe par un Snapshot.
+type Registry struct {
+	tools   []Tool
+	sources []func() []Tool
+}
+
+func (r *Registry) Register(tools ...Tool)      { r.tools = append(r.tools, tools...) }
+func (r *Registry) AddSource(src func() []Tool) { r.sources = append(r.sources, src) }
+
+func (r *Registry) All() []Tool {
+	all := slices.Clone(r.tools)
+	for _, src := range r.sources { all = append(all, src()...) }
+	return all
+}
+
+// Snapshot fige la liste : les sources ne sont appelées qu'ici, pas à chaque Lookup.
+func (r *Registry) Snapshot() *Registry { return &Registry{tools: r.All()} }
+
+// Only renvoie un registre réduit aux outils nommés, dans l'ordre du registre complet.
+func (r *Registry) Only(names []string) *Registry {
+	sub := &Registry{}
+	for _, t := range r.All() {
+		if slices.Contains(names, t.Name()) { sub.tools = append(sub.tools, t) }
+	}
+	return sub
+}
+
+func (r *Registry) Lookup(name string) Tool {
+	for _, t := range r.All() {
+		if t.Name() == name { return t }
+	}
+	return nil
+}
+
+// OpenAISchemas : format "tools" de l'API chat completions (Mistral, OpenAI...).
+func (r *Registry) OpenAISchemas() []interface{} {
+	var out []interface{}
+	for _, t := range r.All() {
+		out = append(out, map[string]interface{}{"type": "function", "function": map[string]interface{}{
+			"name": t.Name(), "description": t.Description(), "parameters": t.Parameters()}})
+	}
+	return out
+}
+
+// GeminiSchemas : format "tools" de l'API Gemini, un seul bloc functionDeclarations. Un outil sans
+// argument (fréquent en MCP) n'a pas de parameters : Gemini refuse un objet sans propriétés.
+func (r *Registry) GeminiSchemas() []interface{} {
+	var decls []interface{}
+	for _, t := range r.All() {
+		decl := map[string]interface{}{"name": t.Name(), "description": t.Description()}
+		params := geminiSchema(t.Parameters())
+		if props, _ := params["properties"].(map[string]interface{}); len(props) > 0 { decl["parameters"] = params }
+		decls = append(decls, decl)
+	}
+	return []interface{}{map[string]interface{}{"functionDeclarations": decls}}
+}
+
+// geminiSchema convertit un JSON Schema vers le sous-ensemble OpenAPI de Gemini : types en
+// majuscules, et ni additionalProperties, ni $schema, ni oneOf.
+func geminiSchema(s map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	typ, _ := s["type"].(string)
+	if types := toStrings(s["type"]); typ == "" && len(types) > 0 { // ["string","null"]
+		for _, t := range types {
+			if t == "null" { out["nullable"] = true } else { typ = t }
+		}
+	}
+	if typ == "" { typ = "string" } // Gemini exige un type
+	out["type"] = strings.ToUpper(typ)
+	for _, k := range []string{"description", "format", "nullable"} {
+		if v, ok := s[k]; ok { out[k] = v }
+	}
+	if enum := toStrings(s["enum"]); len(enum) > 0 {
+		out["enum"], out["format"] = enum, "enum"
+	}
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		p := map[string]interface{}{}
+		for k, v := range props {
+			if m, ok := v.(map[string]interface{}); ok { p[k] = geminiSchema(m) }
+		}
+		out["properties"] = p
+		if req := toStrings(s["required"]); len(req) > 0 { out["required"] = req }
+	}
+	if items, ok := s["items"].(map[string]interface{}); ok { out["items"] = geminiSchema(items) }
+	return out
+}
@@ -0,0 +1,147 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type inner struct {
+	Name string `json:"name"`
+}
+
+type sample struct {
+	inner
+	Path   string            `json:"path" desc:"file to read"`
+	Limit  int               `json:"limit,omitempty"`
+	Ratio  float64           `json:"ratio,omitempty"`
+	All    bool              `json:"all,omitempty"`
+	Mode   string            `json:"mode,omitempty" enum:"fast,slow"`
+	Tags   []string          `json:"tags,omitempty"`
+	Env    map[string]string `json:"env,omitempty"`
+	Skip   string            `json:"-"`
+	hidden string
+}
+
+// decode simule des arguments reçus du modèle (les nombres deviennent des float64).
+func decode(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil { t.Fatal(err) }
+	return m
+}
+
+func TestSchemaOf(t *testing.T) {
+	got := schemaOf(reflect.TypeFor[sample]())
+	want := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":  map[string]interface{}{"type": "string"},
+			"path":  map[string]interface{}{"type": "string", "description": "file to read"},
+			"limit": map[string]interface{}{"type": "integer"},
+			"ratio": map[string]interface{}{"type": "number"},
+			"all":   map[string]interface{}{"type": "boolean"},
+			"mode":  map[string]interface{}{"type": "string", "enum": []string{"fast", "slow"}},
+			"tags":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"env":   map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+		},
+		"required": []string{"name", "path"},
+	}
+	if !reflect.DeepEqual(got, want) { t.Errorf("schemaOf:\n got %v\nwant %v", got, want) }
+
+	if s := schemaOf(reflect.TypeFor[struct{}]()); s["required"] != nil { t.Errorf("empty struct has required: %v", s) }
+	if s := schemaOf(reflect.TypeFor[*int]()); s["type"] != "integer" { t.Errorf("pointer: %v", s) }
+}
+
+func TestValidate(t *testing.T) {
+	schema := schemaOf(reflect.TypeFor[sample]())
+	nested := map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"rows": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}}},
+	}}
+	for _, c := range []struct {
+		schema map[string]interface{}
+		args   string
+		err    string // "" : valide ; sinon extrait attendu du message
+	}{
+		{schema, `{"name":"a","path":"x"}`, ""},
+		{schema, `{"name":"a","path":"x","limit":3,"ratio":0.5,"all":true,"mode":"fast","tags":["t"],"env":{"K":"v"}}`, ""},
+		{schema, `{"name":"a","path":"x","limit":3.0}`, ""},                           // entier écrit en flottant
+		{schema, `{"name":"a","path":"x","ratio":2}`, ""},                             // un entier est un number
+		{schema, `{"name":"a","path":"x","limit":null}`, ""},                          // null = absent
+		{schema, `{"name":"a"}`, `missing required "path"`},
+		{schema, `{"name":"a","path":null}`, `missing required "path"`},
+		{schema, `{"name":"a","path":3}`, "path must be a string, got integer"},
+		{schema, `{"name":"a","path":"x","limit":1.5}`, "limit must be an integer, got number"},
+		{schema, `{"name":"a","path":"x","all":"yes"}`, "all must be a boolean, got string"},
+		{schema, `{"name":"a","path":"x","mode":"medium"}`, "mode must be one of: fast, slow"},
+		{schema, `{"name":"a","path":"x","tags":"t"}`, "tags must be an array, got string"},
+		{schema, `{"name":"a","path":"x","tags":["t",1]}`, "tags[1] must be a string, got integer"},
+		{schema, `{"name":"a","path":"x","env":{"K":1}}`, "env.K must be a string, got integer"},
+		{schema, `{"name":"a","path":"x","pth":"y"}`, `unknown argument "pth"`},
+		{nested, `{"rows":[[1,2],[3]]}`, ""},
+		{nested, `{"rows":[[1,2],[3,"x"]]}`, "rows[1][1] must be an integer, got string"},
+		{nested, `{"rows":{}}`, "rows must be an array, got object"},
+	} {
+		err := Validate(c.schema, decode(t, c.args))
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", c.args, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %q", c.args, err, c.err)
+		}
+	}
+}
+
+func TestGeminiSchema(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{`{"type":"string"}`, `{"type":"STRING"}`},
+		{`{"type":"string","enum":["a","b"],"description":"d"}`, `{"type":"STRING","enum":["a","b"],"format":"enum","description":"d"}`},
+		{`{"type":["integer","null"]}`, `{"type":"INTEGER","nullable":true}`},
+		{`{"description":"anything"}`, `{"type":"STRING","description":"anything"}`},
+		{`{"type":"array","items":{"type":"number"}}`, `{"type":"ARRAY","items":{"type":"NUMBER"}}`},
+		{`{"type":"object","additionalProperties":{"type":"string"},"$schema":"x"}`, `{"type":"OBJECT"}`},
+		{`{"type":"object","properties":{"p":{"type":"boolean"}},"required":["p"]}`, `{"type":"OBJECT","properties":{"p":{"type":"BOOLEAN"}},"required":["p"]}`},
+	} {
+		var in, want map[string]interface{}
+		json.Unmarshal([]byte(c.in), &in)
+		json.Unmarshal([]byte(c.want), &want)
+		got, _ := json.Marshal(geminiSchema(in))
+		var norm map[string]interface{} // []string et []interface{} : on compare après un passage en JSON
+		json.Unmarshal(got, &norm)
+		if !reflect.DeepEqual(norm, want) { t.Errorf("%s:\n got %s\nwant %s", c.in, got, c.want) }
+	}
+}
+
+func TestExecuteAndRegistry(t *testing.T) {
+	echo := New("echo", "Echo", func(_ context.Context, a sample) (string, error) {
+		if a.Path == "fail" { return "", errors.New("cannot echo fail") }
+		return a.Name + ":" + a.Path, nil
+	})
+	var r Registry
+	r.Register(echo)
+	listed := 0
+	r.AddSource(func() []Tool {
+		listed++
+		return []Tool{New("late", "Added by a source", func(context.Context, struct{}) (string, error) { return "ok", nil })}
+	})
+
+	if got, err := echo.Execute(context.Background(), decode(t, `{"name":"n","path":"p"}`)); got != "n:p" || err != nil { t.Errorf("Execute = %q, %v", got, err) }
+	if _, err := echo.Execute(context.Background(), decode(t, `{"name":"n","path":"fail"}`)); err == nil || err.Error() != "cannot echo fail" { t.Errorf("Execute(fail) error = %v", err) }
+	if _, err := echo.Execute(context.Background(), nil); err == nil || !strings.HasPrefix(err.Error(), "invalid arguments for echo: missing required") { t.Errorf("Execute(nil) error = %v", err) }
+	if r.Lookup("late") == nil || r.Lookup("nope") != nil { t.Error("Lookup does not see sources") }
+	if sub := r.Only([]string{"late"}); len(sub.All()) != 1 || sub.All()[0].Name() != "late" { t.Errorf("Only = %v", sub.All()) }
+	listed = 0
+	snap := r.Snapshot()
+	if snap.Lookup("late") == nil || snap.Lookup("echo") == nil || len(snap.Only([]string{"late"}).All()) != 1 || listed != 1 { t.Errorf("Snapshot called the source %d times", listed) }
+
+	decls := r.GeminiSchemas()[0].(map[string]interface{})["functionDeclarations"].([]interface{})
+	if len(decls) != 2 { t.Fatalf("GeminiSchemas: %d declarations", len(decls)) }
+	if _, ok := decls[0].(map[string]interface{})["parameters"]; !ok { t.Error("GeminiSchemas: echo has no parameters") }
+	if _, ok := decls[1].(map[string]interface{})["parameters"]; ok { t.Error("GeminiSchemas: a tool without arguments must not send an empty object") }
+	if fn := r.OpenAISchemas()[0].(map[string]interface{})["function"].(map[string]interface{}); fn["name"] != "echo" { t.Errorf("OpenAISchemas: %v", fn) }
+}
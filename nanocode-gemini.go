@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,6 +14,10 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"pdftomd/internal/mcp"
+	"pdftomd/internal/shell"
+	"pdftomd/internal/tool"
 )
 
 // --- Configuration ---
@@ -21,6 +27,21 @@ var (
 	GeminiKey = os.Getenv("GEMINI_API_KEY")
 )
 
+// Config : sous-ensemble de .nanocode/config.json lu par ce build (même fichier que nanocode.go).
+type Config struct {
+	MCPServers map[string]mcp.Server `json:"mcp_servers"` // nom -> serveur MCP dont les outils s'ajoutent aux nôtres
+}
+
+var Cfg Config
+
+func loadConfig() {
+	data, err := os.ReadFile(filepath.Join(".nanocode", "config.json"))
+	if err != nil { return }
+	if err := json.Unmarshal(data, &Cfg); err != nil {
+		fmt.Printf("%sWarning: .nanocode/config.json ignored: %v%s\n", Yellow, err, Reset)
+	}
+}
+
 // --- ANSI Colors ---
 const (
 	Reset  = "\033[0m"
@@ -55,31 +76,10 @@ type Content struct {
 	Parts []Part `json:"parts"`
 }
 
-type Tool struct {
-	FunctionDeclarations []FunctionDecl `json:"functionDeclarations"`
-}
-
-type FunctionDecl struct {
-	Name        string      `json:"name"`
-	Description string      `json:"description"`
-	Parameters  ParamSchema `json:"parameters"`
-}
-
-type ParamSchema struct {
-	Type       string              `json:"type"`
-	Properties map[string]Property `json:"properties"`
-	Required   []string            `json:"required,omitempty"`
-}
-
-type Property struct {
-	Type        string `json:"type"`
-	Description string `json:"description"`
-}
-
 type RequestBody struct {
-	Contents          []Content `json:"contents"`
-	Tools             []Tool    `json:"tools,omitempty"`
-	SystemInstruction *Content  `json:"systemInstruction,omitempty"`
+	Contents          []Content     `json:"contents"`
+	Tools             []interface{} `json:"tools,omitempty"`
+	SystemInstruction *Content      `json:"systemInstruction,omitempty"`
 }
 
 type ResponseBody struct {
@@ -94,109 +94,144 @@ type ResponseBody struct {
 }
 
 // --- Outils ---
-func toolRead(args map[string]interface{}) string {
-	path, _ := args["path"].(string)
-	data, err := os.ReadFile(path)
-	if err != nil { return "error: " + err.Error() }
+type readArgs struct {
+	Path   string `json:"path"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+func toolRead(_ context.Context, a readArgs) (string, error) {
+	data, err := os.ReadFile(a.Path)
+	if err != nil { return "", err }
 	lines := strings.Split(string(data), "\n")
-	offset := 0
-	if v, ok := args["offset"]; ok { offset = int(v.(float64)) }
+	offset := max(a.Offset, 0)
 	limit := len(lines)
-	if v, ok := args["limit"]; ok { limit = int(v.(float64)) }
+	if a.Limit > 0 { limit = a.Limit }
 	end := offset + limit
 	if end > len(lines) { end = len(lines) }
-	if offset >= len(lines) { return "EOF" }
+	if offset >= len(lines) { return "EOF", nil }
 	var sb strings.Builder
 	for i, line := range lines[offset:end] {
 		sb.WriteString(fmt.Sprintf("%4d| %s\n", offset+i+1, line))
 	}
-	return sb.String()
+	return sb.String(), nil
 }
 
-func toolWrite(args map[string]interface{}) string {
-	path, _ := args["path"].(string)
-	content, _ := args["content"].(string)
-	err := os.WriteFile(path, []byte(content), 0644)
-	if err != nil { return "error: " + err.Error() }
-	return "ok"
+type writeArgs struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
 }
 
-func toolEdit(args map[string]interface{}) string {
-	path, _ := args["path"].(string)
-	oldStr, _ := args["old"].(string)
-	newStr, _ := args["new"].(string)
+func toolWrite(_ context.Context, a writeArgs) (string, error) {
+	err := os.WriteFile(a.Path, []byte(a.Content), 0644)
+	if err != nil { return "", err }
+	return "ok", nil
+}
+
+type editArgs struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	All  bool   `json:"all,omitempty"`
+}
+
+func toolEdit(_ context.Context, a editArgs) (string, error) {
+	path, oldStr, newStr := a.Path, a.Old, a.New
 	data, err := os.ReadFile(path)
-	if err != nil { return "error: " + err.Error() }
+	if err != nil { return "", err }
 	text := string(data)
-	if !strings.Contains(text, oldStr) { return "error: old_string not found" }
+	if !strings.Contains(text, oldStr) { return "", errors.New("old_string not found") }
 	count := strings.Count(text, oldStr)
-	replaceAll := false
-	if v, ok := args["all"]; ok { replaceAll = v.(bool) }
-	if count > 1 && !replaceAll { return fmt.Sprintf("error: old_string appears %d times, use all=true", count) }
+	if count > 1 && !a.All { return "", fmt.Errorf("old_string appears %d times, use all=true", count) }
 	n := 1
-	if replaceAll { n = -1 }
+	if a.All { n = -1 }
 	newText := strings.Replace(text, oldStr, newStr, n)
-	if err := os.WriteFile(path, []byte(newText), 0644); err != nil { return "error: " + err.Error() }
-	return "ok"
+	if err := os.WriteFile(path, []byte(newText), 0644); err != nil { return "", err }
+	return "ok", nil
+}
+
+type globArgs struct {
+	Pat  string `json:"pat"`
+	Path string `json:"path,omitempty"`
 }
 
-func toolGlob(args map[string]interface{}) string {
-	pat, _ := args["pat"].(string)
+func toolGlob(_ context.Context, a globArgs) (string, error) {
 	root := "."
-	if v, ok := args["path"]; ok { root = v.(string) }
-	pattern := filepath.Join(root, pat)
+	if a.Path != "" { root = a.Path }
+	pattern := filepath.Join(root, a.Pat)
 	matches, err := filepath.Glob(pattern)
-	if err != nil { return "error: " + err.Error() }
+	if err != nil { return "", err }
 	sort.Slice(matches, func(i, j int) bool {
 		infoI, _ := os.Stat(matches[i])
 		infoJ, _ := os.Stat(matches[j])
 		return infoI.ModTime().After(infoJ.ModTime())
 	})
-	if len(matches) == 0 { return "none" }
-	return strings.Join(matches, "\n")
+	if len(matches) == 0 { return "none", nil }
+	return strings.Join(matches, "\n"), nil
 }
 
-func toolBash(args map[string]interface{}) string {
-	cmdStr, _ := args["cmd"].(string)
-	cmd := exec.Command("bash", "-c", cmdStr)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	done := make(chan error, 1)
-	go func() { done <- cmd.Run() }()
-	select {
-	case <-time.After(30 * time.Second):
-		if cmd.Process != nil { cmd.Process.Kill() }
-		return out.String() + "\n(timed out)"
-	case err := <-done:
-		if err != nil { return out.String() + "\n" + err.Error() }
-	}
-	res := strings.TrimSpace(out.String())
-	if res == "" { return "(empty)" }
-	return res
+type bashArgs struct {
+	Cmd     string `json:"cmd"`
+	Timeout int    `json:"timeout,omitempty" desc:"seconds, default 120, max 600"`
+	Cwd     string `json:"cwd,omitempty" desc:"working directory"`
 }
 
-// --- Main Logic ---
+func toolBash(_ context.Context, a bashArgs) (string, error) {
+	if a.Cmd == "" { return "", errors.New("cmd missing") }
+	timeout := shell.DefaultTimeout
+	if a.Timeout > 0 { timeout = time.Duration(a.Timeout) * time.Second }
+	if timeout > shell.MaxTimeout { timeout = shell.MaxTimeout }
+	return runShell(a.Cmd, a.Cwd, timeout).String(), nil
+}
+
+// --- Shell (internal/shell, shared with nanocode.go) ---
+
+func runShell(cmdStr, dir string, timeout time.Duration) shell.Result {
+	return shell.Run(context.Background(), timeout, nil, func(ctx context.Context) (*exec.Cmd, error) {
+		cmd := exec.CommandContext(ctx, "bash", "-c", cmdStr)
+		cmd.Dir = dir
+		return cmd, nil
+	})
+}
 
-func defineTools() []Tool {
-	return []Tool{{
-		FunctionDeclarations: []FunctionDecl{
-			{Name: "read", Description: "Read file", Parameters: ParamSchema{Type: "OBJECT", Required: []string{"path"}, Properties: map[string]Property{"path": {Type: "STRING"}, "offset": {Type: "INTEGER"}, "limit": {Type: "INTEGER"}}}},
-			{Name: "write", Description: "Write file", Parameters: ParamSchema{Type: "OBJECT", Required: []string{"path", "content"}, Properties: map[string]Property{"path": {Type: "STRING"}, "content": {Type: "STRING"}}}},
-			{Name: "edit", Description: "Replace string", Parameters: ParamSchema{Type: "OBJECT", Required: []string{"path", "old", "new"}, Properties: map[string]Property{"path": {Type: "STRING"}, "old": {Type: "STRING"}, "new": {Type: "STRING"}, "all": {Type: "BOOLEAN"}}}},
-			{Name: "bash", Description: "Run shell cmd", Parameters: ParamSchema{Type: "OBJECT", Required: []string{"cmd"}, Properties: map[string]Property{"cmd": {Type: "STRING"}}}},
-			{Name: "glob", Description: "List files", Parameters: ParamSchema{Type: "OBJECT", Required: []string{"pat"}, Properties: map[string]Property{"pat": {Type: "STRING"}, "path": {Type: "STRING"}}}},
-		},
-	}}
+// --- Registre d'outils (internal/tool, partagé avec nanocode.go) ---
+
+var registry tool.Registry
+
+var mcpServers = &mcp.Set{}
+
+func init() {
+	registry.Register(
+		tool.New("read", "Read file", toolRead),
+		tool.New("write", "Write file", toolWrite),
+		tool.New("edit", "Replace string", toolEdit),
+		tool.New("bash", "Run shell cmd", toolBash),
+		tool.New("glob", "List files", toolGlob),
+	)
+	registry.AddSource(func() []tool.Tool { return mcpServers.Tools() }) // outils MCP, après startMCP
+}
+
+// startMCP connecte les serveurs de mcp_servers (internal/mcp, même client que nanocode.go).
+func startMCP() {
+	mcpServers = mcp.Start(Cfg.MCPServers, func(msg string) { fmt.Printf("%s%s%s\n", Dim, msg, Reset) })
+	for _, c := range mcpServers.Clients {
+		if c.Err != nil {
+			fmt.Printf("%sWarning: MCP server %s unavailable: %v%s\n", Yellow, c.Name, c.Err, Reset)
+		} else {
+			fmt.Printf("%sMCP server %s: %d tools%s\n", Dim, c.Name, len(c.Listed()), Reset)
+		}
+	}
 }
 
-func callGemini(history []Content, sysPrompt string) (*ResponseBody, error) {
+// --- Main Logic ---
+
+func callGemini(history []Content, sysPrompt string, tools *tool.Registry) (*ResponseBody, error) {
 	// URL Directe v1beta standard
 	url := "https://generativelanguage.googleapis.com/v1beta/models/" + CurrentModel + ":generateContent?key=" + GeminiKey
 
 	body := RequestBody{
 		Contents:          history,
-		Tools:             defineTools(),
+		Tools:             tools.GeminiSchemas(),
 		SystemInstruction: &Content{Parts: []Part{{Text: sysPrompt}}},
 	}
 
@@ -231,6 +266,10 @@ func main() {
 		return
 	}
 
+	loadConfig()
+	startMCP()
+	defer mcpServers.Close()
+
 	cwd, _ := os.Getwd()
 	fmt.Printf("%snanocode-go%s | %s%s%s | %s\n\n", Bold, Reset, Dim, CurrentModel, Reset, cwd)
 
@@ -253,7 +292,9 @@ func main() {
 		history = append(history, Content{Role: "user", Parts: []Part{{Text: input}}})
 
 		for {
-			resp, err := callGemini(history, sysPrompt)
+			// Outils figés pour cet appel : les serveurs MCP ne sont relistés qu'ici
+			tools := registry.Snapshot()
+			resp, err := callGemini(history, sysPrompt, tools)
 			if err != nil {
 				fmt.Printf("%s%v%s\n", Red, err, Reset)
 				break
@@ -281,14 +322,9 @@ func main() {
 					fmt.Printf("\n%s⏺ %s%s\n", Green, strings.ToUpper(fc.Name), Reset)
 					
 					var result string
-					switch fc.Name {
-					case "read": result = toolRead(fc.Args)
-					case "write": result = toolWrite(fc.Args)
-					case "edit": result = toolEdit(fc.Args)
-					case "glob": result = toolGlob(fc.Args)
-					case "bash": result = toolBash(fc.Args)
-					default: result = "unknown tool"
-					}
+					err := errors.New("unknown tool")
+					if t := tools.Lookup(fc.Name); t != nil { result, err = t.Execute(context.Background(), fc.Args) }
+					if err != nil { result = "error: " + err.Error() }
 					
 					// Preview simple
 					preview := strings.ReplaceAll(result, "\n", " ")
@@ -3,15 +3,46 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"pdftomd/internal/mcp"
+	"pdftomd/internal/mention"
+	"pdftomd/internal/shell"
+	"pdftomd/internal/textfile"
+	"pdftomd/internal/tool"
 )
 
 // --- CONFIGURATION ---
@@ -20,6 +51,33 @@ const MistralURL = "https://api.mistral.ai/v1/chat/completions"
 
 var MistralKey = os.Getenv("MISTRAL_API_KEY")
 
+// Config projet, lue depuis .nanocode/config.json (tout est optionnel).
+type Config struct {
+	Shell struct {
+		Persistent bool   `json:"persistent"` // un seul bash garde cd/export entre les appels
+		Sandbox    string `json:"sandbox"`    // "", "auto", "bwrap" ou "namespace" (Linux)
+	} `json:"shell"`
+	RepoMapTokens int `json:"repo_map_tokens"` // 0 = défaut, négatif = pas de carte du dépôt
+	Search        struct {
+		EmbeddingsURL   string `json:"embeddings_url"` // endpoint d'embeddings compatible OpenAI, vide = BM25 seul
+		EmbeddingsModel string `json:"embeddings_model"`
+	} `json:"search"`
+	LSP        []LSPServer             `json:"lsp"`         // serveurs de langage, démarrés au premier fichier concerné
+	PostWrite  map[string][]string     `json:"post_write"`  // ".go" ou "*_test.go" -> commandes lancées après write ({file}, {dir})
+	Hooks      map[string][]HookConfig `json:"hooks"`       // événement -> scripts (voir HOOKS)
+	MCPServers map[string]mcp.Server   `json:"mcp_servers"` // nom -> serveur MCP dont les outils s'ajoutent aux nôtres
+}
+
+var Cfg Config
+
+func loadConfig() {
+	data, err := os.ReadFile(filepath.Join(".nanocode", "config.json"))
+	if err != nil { return }
+	if err := json.Unmarshal(data, &Cfg); err != nil {
+		fmt.Printf("%sWarning: .nanocode/config.json ignored: %v%s\n", Yellow, err, Reset)
+	}
+}
+
 // --- COULEURS ---
 const (
 	Reset   = "\033[0m"
@@ -55,8 +113,11 @@ type Message struct {
 type StreamResponse struct {
 	Choices []struct {
 		Delta struct {
-			Content   string     `json:"content"`
-			ToolCalls []ToolCall `json:"tool_calls"`
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index int `json:"index"` // plusieurs appels parallèles arrivent dans le même tableau
+				ToolCall
+			} `json:"tool_calls"`
 		} `json:"delta"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
@@ -71,248 +132,3981 @@ type RequestBody struct {
 	Stream      bool          `json:"stream"`
 }
 
+// --- SHELL (internal/shell, partagé avec nanocode-gemini.go) ---
+
+// liveWriter recopie la sortie d'une commande dans le terminal, en gris, au fil de l'eau.
+type liveWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	midLine bool
+}
+
+func (l *liveWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString(Dim)
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" { continue }
+		if !l.midLine { sb.WriteString("  │ ") }
+		sb.WriteString(line)
+		l.midLine = !strings.HasSuffix(line, "\n")
+	}
+	sb.WriteString(Reset)
+	fmt.Fprint(l.w, sb.String())
+	return len(p), nil
+}
+
+func (l *liveWriter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.midLine { fmt.Fprintln(l.w); l.midLine = false }
+}
+
+// runShell exécute cmdStr via bash, dans le sandbox configuré. live (optionnel) reçoit la sortie
+// en direct ; annuler parent interrompt la commande.
+func runShell(parent context.Context, cmdStr, dir string, timeout time.Duration, live io.Writer) shell.Result {
+	return shell.Run(parent, timeout, live, func(ctx context.Context) (*exec.Cmd, error) {
+		return shellCommand(ctx, dir, "bash", "-c", cmdStr)
+	})
+}
+
+// --- SANDBOX ---
+
+// sandboxPrelude tourne dans les nouveaux namespaces user/mount/net : tout devient
+// lecture seule sauf le projet (et /tmp, remplacé par un tmpfs), puis exec la vraie commande.
+const sandboxPrelude = `P="$1"; D="$2"; shift 2
+mount --bind "$P" "$P" || exit 97
+awk '{print $2}' /proc/self/mounts | sort -u | while read -r mp; do
+	mp=$(printf '%b' "$mp")
+	[ "$mp" = "$P" ] || mount -o remount,bind,ro "$mp" 2>/dev/null
+done
+case "$P/" in /tmp/*) ;; *) mount -t tmpfs tmpfs /tmp ;; esac
+cd "$D" && exec "$@"`
+
+// sandboxBackend résout shell.sandbox en backend concret ("" = pas de sandbox).
+func sandboxBackend() (string, error) {
+	mode := Cfg.Shell.Sandbox
+	if mode == "" || mode == "none" { return "", nil }
+	_, errBwrap := exec.LookPath("bwrap")
+	_, errUnshare := exec.LookPath("unshare")
+	switch {
+	case mode == "bwrap" && errBwrap == nil:
+		return "bwrap", nil
+	case mode == "namespace" && runtime.GOOS == "linux" && errUnshare == nil:
+		return "namespace", nil
+	case mode == "auto" && errBwrap == nil:
+		return "bwrap", nil
+	case mode == "auto" && runtime.GOOS == "linux" && errUnshare == nil:
+		return "namespace", nil
+	}
+	return "", fmt.Errorf("sandbox %q unavailable on this system", mode)
+}
+
+// shellCommand prépare argv dans dir, enveloppé dans le sandbox configuré.
+// Si un sandbox est demandé mais indisponible, on refuse plutôt que d'exécuter sur l'hôte.
+func shellCommand(ctx context.Context, dir string, argv ...string) (*exec.Cmd, error) {
+	backend, err := sandboxBackend()
+	if err != nil { return nil, err }
+	if backend == "" {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Dir = dir
+		return cmd, nil
+	}
+	root, err := os.Getwd()
+	if err != nil { return nil, err }
+	wd := root
+	if dir != "" {
+		if wd, err = filepath.Abs(dir); err != nil { return nil, err }
+	}
+	var args []string
+	switch backend {
+	case "bwrap":
+		args = []string{"bwrap", "--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp",
+			"--bind", root, root, "--unshare-all", "--die-with-parent", "--chdir", wd, "--"}
+	case "namespace":
+		args = []string{"unshare", "--user", "--map-root-user", "--mount", "--net", "--fork",
+			"bash", "-c", sandboxPrelude, "nanocode-sandbox", root, wd}
+	}
+	args = append(args, argv...)
+	return exec.CommandContext(ctx, args[0], args[1:]...), nil
+}
+
+// --- SHELL PERSISTANT ---
+
+// shellSession est un bash unique qui sert tous les appels quand shell.persistent est actif.
+// Chaque commande est suivie d'une sentinelle qui porte son code de sortie.
+type shellSession struct {
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string
+}
+
+var bashShell = &shellSession{}
+
+func (s *shellSession) start() error {
+	cmd, err := shellCommand(context.Background(), "", "bash", "--noprofile", "--norc")
+	if err != nil { return err }
+	shell.SetProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil { return err }
+	pr, pw, err := os.Pipe()
+	if err != nil { return err }
+	cmd.Stdout = pw; cmd.Stderr = pw
+	if err := cmd.Start(); err != nil { pr.Close(); pw.Close(); return err }
+	pw.Close()
+
+	lines := make(chan string, 256)
+	go func() {
+		r := bufio.NewReader(pr)
+		for {
+			line, err := r.ReadString('\n')
+			if line != "" { lines <- line }
+			if err != nil { break }
+		}
+		pr.Close()
+		close(lines)
+		cmd.Wait()
+	}()
+	s.cmd, s.stdin, s.lines = cmd, stdin, lines
+	// Ctrl-C/timeout interrompt la commande en cours, pas la session
+	_, err = io.WriteString(stdin, "trap : INT\n")
+	return err
+}
+
+func (s *shellSession) stop() {
+	if s.cmd == nil { return }
+	s.stdin.Close()
+	shell.KillProcessGroup(s.cmd)
+	s.cmd = nil
+}
+
+// Close termine la session ; la prochaine commande en démarre une nouvelle.
+func (s *shellSession) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+func shellQuote(v string) string { return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'" }
+
+// ansiCQuote encode v en $'...' pour l'envoyer sur une seule ligne au bash de la session.
+func ansiCQuote(v string) string {
+	var sb strings.Builder
+	sb.WriteString("$'")
+	for _, b := range []byte(v) {
+		switch {
+		case b == '\\' || b == '\'':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < 0x20 || b == 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+func (s *shellSession) Run(parent context.Context, cmdStr, dir string, timeout time.Duration, live io.Writer) shell.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil {
+		if err := s.start(); err != nil { return shell.Result{ExitCode: -1, Output: "Error: " + err.Error()} }
+	}
+
+	// eval dans le shell courant : cd/export restent dans la session. Avec dir, on y entre puis on
+	// revient au dossier d'avant (pas de sous-shell : export et venv activé sont gardés).
+	src := "eval " + ansiCQuote(cmdStr) + " < /dev/null; __nc_st=$?"
+	if dir != "" {
+		src = "__nc_pwd=$PWD; if builtin cd -- " + shellQuote(dir) + "; then " + src +
+			"; builtin cd -- \"$__nc_pwd\"; else __nc_st=$?; fi"
+	}
+	sentinel := fmt.Sprintf("__NANOCODE_DONE_%d__", time.Now().UnixNano())
+	script := fmt.Sprintf("%s; printf '\\n%s %%d\\n' \"$__nc_st\"\n", src, sentinel)
+
+	out := shell.NewBuffer(shell.OutputCap)
+	var w io.Writer = out
+	if live != nil { w = io.MultiWriter(out, live) }
+	start := time.Now()
+	res := shell.Result{ExitCode: -1}
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		s.stop()
+		return shell.Result{ExitCode: -1, Output: "Error: shell session lost: " + err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	var grace <-chan time.Time
+	blank := false // ligne vide retenue : c'est peut-être celle qui précède la sentinelle
+loop:
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.stop()
+				res.Output = "(shell exited; a new session will start on next call)"
+				break loop
+			}
+			if strings.HasPrefix(line, sentinel+" ") {
+				fmt.Sscanf(strings.TrimPrefix(line, sentinel+" "), "%d", &res.ExitCode)
+				break loop
+			}
+			if blank { w.Write([]byte("\n")); blank = false }
+			if line == "\n" { blank = true; continue }
+			w.Write([]byte(line))
+		case <-ctx.Done():
+			res.Interrupted = parent.Err() != nil
+			res.TimedOut = !res.Interrupted
+			shell.InterruptProcessGroup(s.cmd)
+			grace = time.After(2 * time.Second)
+			ctx = context.Background() // ne re-déclenche pas ce cas
+		case <-grace:
+			s.stop()
+			res.Output = "(command did not stop; shell session restarted, cd/export state lost)"
+			break loop
+		}
+	}
+	res.Duration = time.Since(start)
+	res.Output = strings.TrimSpace(strings.TrimSpace(out.String()) + "\n" + res.Output)
+	res.Dropped = out.Dropped()
+	return res
+}
+
 // --- OUTILS ---
 
-func toolRead(args map[string]interface{}) string {
-	path, ok := args["path"].(string)
-	if !ok { return "Error: path missing" }
+type readArgs struct {
+	Path string `json:"path"`
+}
+
+func toolRead(ctx context.Context, a readArgs) (string, error) {
+	path := a.Path
 	data, err := os.ReadFile(path)
-	if err != nil { return "Error: " + err.Error() }
-	if len(data) > 6000 { return string(data[:6000]) + "\n...[TRUNCATED]..." }
-	return string(data)
+	if err != nil { return "", err }
+	if len(data) > 6000 { return string(data[:6000]) + "\n...[TRUNCATED]..." + nestedAgents(ctx, path), nil }
+	return string(data) + nestedAgents(ctx, path), nil
 }
 
-func toolWrite(args map[string]interface{}) string {
-	path, _ := args["path"].(string)
-	content, _ := args["content"].(string)
+type writeArgs struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+func toolWrite(ctx context.Context, a writeArgs) (string, error) {
+	path, content := a.Path, a.Content
 	err := os.WriteFile(path, []byte(content), 0644)
-	if err != nil { return "Error: " + err.Error() }
-	return "Success."
+	if err != nil { return "", err }
+	return "Success." + postWrite(ctx, path, content) + lspAfterWrite(path), nil
 }
 
-func toolBash(args map[string]interface{}) string {
-	cmdStr, _ := args["cmd"].(string)
-	cmd := exec.Command("bash", "-c", cmdStr)
-	var out bytes.Buffer
-	cmd.Stdout = &out; cmd.Stderr = &out
-	err := cmd.Run()
-	output := strings.TrimSpace(out.String())
-	if err != nil { return fmt.Sprintf("Failed: %s\n%s", err.Error(), output) }
-	if output == "" { return "Done (no output)" }
-	return output
+type editArgs struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	All  bool   `json:"all,omitempty"`
 }
 
-func toolGlob(args map[string]interface{}) string {
-	pat, _ := args["pat"].(string)
-	matches, _ := filepath.Glob(pat)
-	if len(matches) == 0 { return "No matches" }
-	sort.Strings(matches)
-	return strings.Join(matches, "\n")
+func toolEdit(ctx context.Context, a editArgs) (string, error) {
+	path, oldStr, newStr := a.Path, a.Old, a.New
+	if oldStr == "" { return "", errors.New("old missing") }
+	data, err := os.ReadFile(path)
+	if err != nil { return "", err }
+	text := string(data)
+	count := strings.Count(text, oldStr)
+	if count == 0 { return "", errors.New("old string not found") }
+	if count > 1 && !a.All { return "", fmt.Errorf("old string appears %d times, add more context or use all=true", count) }
+	n := 1
+	if a.All { n = count }
+	text = strings.Replace(text, oldStr, newStr, n)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil { return "", err }
+	return fmt.Sprintf("Success (%d replaced).", n) + postWrite(ctx, path, text) + lspAfterWrite(path), nil
 }
 
-func getTools() []interface{} {
-	return []interface{}{
-		map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "read", "description": "Read file", "parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"path": map[string]string{"type": "string"}}, "required": []string{"path"}}}},
-		map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "write", "description": "Write file", "parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"path": map[string]string{"type": "string"}, "content": map[string]string{"type": "string"}}, "required": []string{"path", "content"}}}},
-		map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "bash", "description": "Run shell cmd", "parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"cmd": map[string]string{"type": "string"}}, "required": []string{"cmd"}}}},
-		map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "glob", "description": "List files *", "parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"pat": map[string]string{"type": "string"}}, "required": []string{"pat"}}}},
+// postWrite lance les commandes post_write qui correspondent au fichier (formatage, vérification),
+// dans l'ordre, en s'arrêtant à la première qui échoue. Leur sortie revient au modèle.
+func postWrite(ctx context.Context, path, content string) string {
+	base := filepath.Base(path)
+	var keys []string
+	for k := range Cfg.PostWrite {
+		ok, _ := filepath.Match(k, base)
+		if ok || (strings.HasPrefix(k, ".") && filepath.Ext(base) == k) { keys = append(keys, k) }
+	}
+	if len(keys) == 0 { return "" }
+	sort.Strings(keys)
+	dir := filepath.Dir(path)
+	if !filepath.IsAbs(dir) && dir != "." && !strings.HasPrefix(dir, "..") { dir = "." + string(filepath.Separator) + dir } // "go vet {dir}"
+	r := strings.NewReplacer("{file}", shellQuote(path), "{dir}", shellQuote(dir))
+	var sb strings.Builder
+	sb.WriteString("\n\nPost-write checks:")
+	failed := false
+	for _, k := range keys {
+		for _, hook := range Cfg.PostWrite[k] {
+			if failed || ctx.Err() != nil { break }
+			cmdStr := r.Replace(hook)
+			fmt.Printf("%s  ↳ %s%s\n", Dim, cmdStr, Reset)
+			res := runShell(ctx, cmdStr, "", shell.DefaultTimeout, nil)
+			fmt.Fprintf(&sb, "\n$ %s\n%s", cmdStr, res)
+			failed = res.ExitCode != 0 || res.TimedOut || res.Interrupted
+		}
+	}
+	if data, err := os.ReadFile(path); err == nil && string(data) != content {
+		sb.WriteString("\n(the file was modified by these commands; read it again before editing)")
 	}
+	return sb.String()
 }
 
-// --- MOTEUR IA (STREAMING) ---
+type bashArgs struct {
+	Cmd     string `json:"cmd"`
+	Timeout int    `json:"timeout,omitempty" desc:"seconds (default 120, max 600)"`
+	Cwd     string `json:"cwd,omitempty"`
+}
 
-func callMistralStream(messages []Message) (string, []ToolCall, error) {
-	reqBody := RequestBody{
-		Model: CurrentModel, Messages: messages, Tools: getTools(), ToolChoice: "auto", Temperature: 0.1, Stream: true,
-	}
-	jsonBody, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", MistralURL, bytes.NewBuffer(jsonBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+MistralKey)
+func toolBash(ctx context.Context, a bashArgs) (string, error) {
+	cmdStr, dir := a.Cmd, a.Cwd
+	if cmdStr == "" { return "", errors.New("cmd missing") }
+	timeout := shell.DefaultTimeout
+	if a.Timeout > 0 { timeout = time.Duration(a.Timeout) * time.Second }
+	if timeout > shell.MaxTimeout { timeout = shell.MaxTimeout }
 
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil { return "", nil, err }
-	defer resp.Body.Close()
+	live := &liveWriter{w: os.Stdout}
+	defer live.Close()
+	if Cfg.Shell.Persistent { return bashShell.Run(ctx, cmdStr, dir, timeout, live).String(), nil }
+	return runShell(ctx, cmdStr, dir, timeout, live).String(), nil
+}
 
-	if resp.StatusCode != 200 { return "", nil, fmt.Errorf("API Error %s", resp.Status) }
+type globArgs struct {
+	Pat string `json:"pat"`
+}
 
-	reader := bufio.NewReader(resp.Body)
-	fullContent := ""
-	var toolCalls []ToolCall
-	
-	currentToolID, currentToolName, currentToolArgs := "", "", ""
-	fmt.Printf("%s", Magenta) // Pensée en violet
+func toolGlob(_ context.Context, a globArgs) (string, error) {
+	matches, _ := filepath.Glob(a.Pat)
+	if len(matches) == 0 { return "No matches", nil }
+	sort.Strings(matches)
+	return strings.Join(matches, "\n"), nil
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil { break }
-		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "data: ") { continue }
-		if line == "data: [DONE]" { break }
-		
-		var chunk StreamResponse
-		json.Unmarshal([]byte(line[6:]), &chunk)
-		
-		if len(chunk.Choices) > 0 {
-			delta := chunk.Choices[0].Delta
-			if delta.Content != "" {
-				fmt.Print(delta.Content)
-				fullContent += delta.Content
+// --- CODE GO (go/parser, go/types) ---
+
+const GoRefsMax = 200
+
+type goPackage struct {
+	Dir   string
+	Name  string
+	Files []*ast.File
+}
+
+// loadGoPackages parse les .go du projet (hors .gitignore, vendor et testdata), regroupés par
+// dossier et nom de package. only limite à un dossier.
+func loadGoPackages(fset *token.FileSet, only string) []*goPackage {
+	var pkgs []*goPackage
+	index := map[string]*goPackage{}
+	walkProject(".", func(rel string, d fs.DirEntry) error {
+		if d.IsDir() {
+			if d.Name() == "vendor" || d.Name() == "testdata" { return filepath.SkipDir }
+			return nil
+		}
+		if !strings.HasSuffix(rel, ".go") { return nil }
+		dir := path.Dir(rel)
+		if only != "" && dir != only { return nil }
+		f, err := parser.ParseFile(fset, rel, nil, parser.ParseComments)
+		if err != nil && f == nil { return nil }
+		key := dir + " " + f.Name.Name
+		if index[key] == nil {
+			index[key] = &goPackage{Dir: dir, Name: f.Name.Name}
+			pkgs = append(pkgs, index[key])
+		}
+		index[key].Files = append(index[key].Files, f)
+		return nil
+	})
+	return pkgs
+}
+
+// goDecl : une déclaration de haut niveau (ou une méthode, Name = "Recv.Method").
+type goDecl struct {
+	Name  string
+	Kind  string
+	Ident *ast.Ident
+	Sig   string
+	Doc   string
+}
+
+func goDecls(fset *token.FileSet, f *ast.File) []goDecl {
+	var decls []goDecl
+	firstLine := func(cg *ast.CommentGroup) string {
+		if cg == nil { return "" }
+		line, _, _ := strings.Cut(strings.TrimSpace(cg.Text()), "\n")
+		return line
+	}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			name, kind := d.Name.Name, "func"
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				name, kind = recvName(d.Recv.List[0].Type)+"."+name, "method"
 			}
-			if len(delta.ToolCalls) > 0 {
-				tc := delta.ToolCalls[0]
-				if tc.ID != "" {
-					if currentToolID != "" {
-						toolCalls = append(toolCalls, ToolCall{ID: currentToolID, Type: "function", Function: struct{Name string "json:\"name\""; Arguments string "json:\"arguments\""}{Name: currentToolName, Arguments: currentToolArgs}})
+			sig := *d
+			sig.Body, sig.Doc = nil, nil
+			decls = append(decls, goDecl{name, kind, d.Name, nodeString(fset, &sig), firstLine(d.Doc)})
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch sp := spec.(type) {
+				case *ast.TypeSpec:
+					kind := "type"
+					switch sp.Type.(type) {
+					case *ast.StructType: kind = "struct"
+					case *ast.InterfaceType: kind = "interface"
+					}
+					doc := sp.Doc
+					if doc == nil { doc = d.Doc }
+					sig := "type " + sp.Name.Name
+					if kind == "type" { sig += " " + nodeString(fset, sp.Type) }
+					decls = append(decls, goDecl{sp.Name.Name, kind, sp.Name, sig, firstLine(doc)})
+				case *ast.ValueSpec:
+					kind := d.Tok.String()
+					doc := sp.Doc
+					if doc == nil { doc = d.Doc }
+					for _, n := range sp.Names {
+						sig := kind + " " + n.Name
+						if sp.Type != nil { sig += " " + nodeString(fset, sp.Type) }
+						decls = append(decls, goDecl{n.Name, kind, n, sig, firstLine(doc)})
 					}
-					currentToolID = tc.ID; currentToolName = tc.Function.Name; currentToolArgs = ""
 				}
-				currentToolArgs += tc.Function.Arguments
 			}
 		}
 	}
-	fmt.Printf("%s\n", Reset)
+	return decls
+}
 
-	if currentToolID != "" {
-		toolCalls = append(toolCalls, ToolCall{ID: currentToolID, Type: "function", Function: struct{Name string "json:\"name\""; Arguments string "json:\"arguments\""}{Name: currentToolName, Arguments: currentToolArgs}})
+func recvName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr: return recvName(t.X)
+	case *ast.IndexExpr: return recvName(t.X)
+	case *ast.IndexListExpr: return recvName(t.X)
+	case *ast.Ident: return t.Name
 	}
-	return fullContent, toolCalls, nil
+	return "?"
 }
 
-// --- GESTION CONTEXTE & ANALYSE ---
+func nodeString(fset *token.FileSet, n any) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fset, n)
+	s := strings.Join(strings.Fields(buf.String()), " ")
+	if len(s) > 200 { s = s[:200] + "..." }
+	return s
+}
 
-func getSystemPrompt(cwd string) string {
-	// 1. Base Prompt (Orchestrator Rules)
-	p := "You are the Orchestrator Agent. CWD: " + cwd + ".\n" +
-		"PROTOCOL: THOUGHT (Explain plan) > ACTION (Use tool) > OBSERVATION > REPEAT.\n" +
-		"Never use a tool without explaining WHY first in the THOUGHT phase."
-	
-	// 2. agents.md (Mémoire persistante)
-	if data, err := os.ReadFile("agents.md"); err == nil {
-		p += "\n\n=== [agents.md] MEMORY & GUIDELINES ===\n" + string(data)
+// optPathArgs : un chemin facultatif (dossier courant ou tous les fichiers si absent).
+type optPathArgs struct {
+	Path string `json:"path,omitempty"`
+}
+
+type goNameArgs struct {
+	Name string `json:"name"`
+}
+
+func toolGoSymbols(_ context.Context, a optPathArgs) (string, error) {
+	dir := path.Clean(filepath.ToSlash(a.Path))
+	fset := token.NewFileSet()
+	pkgs := loadGoPackages(fset, dir)
+	if len(pkgs) == 0 { return "No Go package in " + dir, nil }
+	var sb strings.Builder
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&sb, "package %s (%s)\n", pkg.Name, pkg.Dir)
+		for _, f := range pkg.Files {
+			for _, d := range goDecls(fset, f) {
+				name := d.Name
+				if i := strings.LastIndex(name, "."); i >= 0 { name = name[i+1:] }
+				if !ast.IsExported(name) { continue }
+				pos := fset.Position(d.Ident.Pos())
+				fmt.Fprintf(&sb, "%s:%d: %s", pos.Filename, pos.Line, d.Sig)
+				if d.Doc != "" { sb.WriteString("  // " + d.Doc) }
+				sb.WriteString("\n")
+			}
+		}
 	}
-	return p
+	return strings.TrimRight(sb.String(), "\n"), nil
 }
 
-func analyzeProject() string {
-	files, _ := filepath.Glob("*")
-	var contentBuilder strings.Builder
-	contentBuilder.WriteString("Analyze these project files. Output a clean Markdown list of Coding Guidelines, patterns, and Architecture notes (max 300 words). Do NOT act as an agent, just output the MD content:\n")
+// findGoDecls accepte "Foo", "Type.Method" ou "pkg.Foo".
+func findGoDecls(fset *token.FileSet, pkgs []*goPackage, name string) []goDecl {
+	var found []goDecl
+	qual, short, hasQual := strings.Cut(name, ".")
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, d := range goDecls(fset, f) {
+				if d.Name == name || (hasQual && qual == pkg.Name && d.Name == short) { found = append(found, d) }
+			}
+		}
+	}
+	return found
+}
 
-	count := 0
-	for _, f := range files {
-		// Exclusion des fichiers binaires, cachés ou mémoire
-		if strings.HasPrefix(f, ".") || f == "nanocode" || f == "agents.md" { continue }
-		info, err := os.Stat(f)
-		if err == nil && !info.IsDir() {
-			data, _ := os.ReadFile(f)
-			if len(data) > 3000 { data = data[:3000] } // Tronque les gros fichiers
-			contentBuilder.WriteString(fmt.Sprintf("\n--- FILE: %s ---\n%s\n", f, string(data)))
-			count++
+func toolGoDefinition(_ context.Context, a goNameArgs) (string, error) {
+	name := a.Name
+	if name == "" { return "", errors.New("name missing") }
+	fset := token.NewFileSet()
+	found := findGoDecls(fset, loadGoPackages(fset, ""), name)
+	if len(found) == 0 { return "No definition of " + name, nil }
+	var sb strings.Builder
+	for _, d := range found {
+		pos := fset.Position(d.Ident.Pos())
+		fmt.Fprintf(&sb, "%s:%d: %s", pos.Filename, pos.Line, d.Sig)
+		if d.Doc != "" { sb.WriteString("  // " + d.Doc) }
+		sb.WriteString("\n")
+	}
+	return strings.TrimRight(sb.String(), "\n"), nil
+}
+
+// toolGoReferences type-check chaque package du projet et garde les identifiants qui pointent
+// vers la définition cherchée (comparée par position, les objets importés étant des copies).
+func toolGoReferences(_ context.Context, a goNameArgs) (string, error) {
+	name := a.Name
+	if name == "" { return "", errors.New("name missing") }
+	fset := token.NewFileSet()
+	pkgs := loadGoPackages(fset, "")
+	defs := findGoDecls(fset, pkgs, name)
+	if len(defs) == 0 { return "No definition of " + name, nil }
+	targets := map[string]bool{}
+	for _, d := range defs { targets[positionKey(fset.Position(d.Ident.Pos()))] = true }
+
+	imp := newProjectImporter(fset, pkgs)
+	for _, pkg := range pkgs { imp.check(pkg) }
+	var refs []string
+	lines := map[string][]string{}
+	for id, obj := range imp.info.Uses {
+		if !imp.ours[obj.Pkg()] || !targets[positionKey(fset.Position(obj.Pos()))] { continue }
+		pos := fset.Position(id.Pos())
+		if lines[pos.Filename] == nil {
+			data, _ := os.ReadFile(pos.Filename)
+			lines[pos.Filename] = strings.Split(string(data), "\n")
 		}
+		text := ""
+		if pos.Line <= len(lines[pos.Filename]) { text = strings.TrimSpace(lines[pos.Filename][pos.Line-1]) }
+		refs = append(refs, fmt.Sprintf("%s:%d:%d: %s", pos.Filename, pos.Line, pos.Column, text))
 	}
-	
-	if count == 0 { return "No files to analyze." }
+	if len(refs) == 0 { return "No references to " + name, nil }
+	sort.Strings(refs)
+	res := fmt.Sprintf("%d reference(s) to %s\n", len(refs), name)
+	if len(refs) > GoRefsMax { refs = append(refs[:GoRefsMax], "...") }
+	return res + strings.Join(refs, "\n"), nil
+}
 
-	msgs := []Message{{Role: "user", Content: contentBuilder.String()}}
-	fmt.Printf("%s(Analyzing project structure to update agents.md...)%s\n", Yellow, Reset)
-	
-	// On utilise la fonction de stream pour voir l'analyse en direct, et on récupère le texte
-	resp, _, err := callMistralStream(msgs)
-	if err != nil { return "" }
-	return resp
+// goExternal garde d'un appel à l'autre les packages hors projet (stdlib, dépendances), type-checkés
+// depuis les sources : les refaire à chaque go_references prenait l'essentiel du temps. Ils ont leur
+// propre FileSet ; le projet, lui, est relu à chaque appel.
+var (
+	goExternalMu sync.Mutex
+	goExternal   types.ImporterFrom
+)
+
+// projectImporter type-check les packages du projet à la demande, dans un seul FileSet et un seul
+// types.Info : un objet importé d'un autre package du projet est le même objet, pas une copie.
+type projectImporter struct {
+	fset    *token.FileSet
+	byPath  map[string]*goPackage
+	checked map[*goPackage]*types.Package
+	ours    map[*types.Package]bool
+	info    *types.Info
 }
 
-// --- MAIN ---
+func newProjectImporter(fset *token.FileSet, pkgs []*goPackage) *projectImporter {
+	imp := &projectImporter{fset: fset, byPath: map[string]*goPackage{}, checked: map[*goPackage]*types.Package{},
+		ours: map[*types.Package]bool{}, info: &types.Info{Uses: map[*ast.Ident]types.Object{}}}
+	module := ""
+	if data, err := os.ReadFile("go.mod"); err == nil { module = modfileModule(string(data)) }
+	for _, pkg := range pkgs {
+		if module == "" || strings.HasSuffix(pkg.Name, "_test") { continue }
+		imp.byPath[path.Join(module, pkg.Dir)] = pkg
+	}
+	return imp
+}
 
-func main() {
-	if MistralKey == "" { fmt.Printf("%sErreur: MISTRAL_API_KEY manquante.%s\n", Red, Reset); return }
-	
-	cwd, _ := os.Getwd()
-	sysPrompt := getSystemPrompt(cwd)
-	
-	fmt.Printf("%snanocode-v7 (Persistent Memory)%s | %s%s%s\n", Bold, Reset, Dim, CurrentModel, Reset)
-	fmt.Printf("Commands: %s/i%s (Init/Update Memory), %s/c%s (Clear Chat), %s/q%s (Quit)\n\n", Green, Reset, Green, Reset, Green, Reset)
+func modfileModule(gomod string) string {
+	for _, line := range strings.Split(gomod, "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[0] == "module" { return strings.Trim(f[1], `"`) }
+	}
+	return ""
+}
 
-	history := []Message{{Role: "system", Content: sysPrompt}}
-	scanner := bufio.NewScanner(os.Stdin)
+func (imp *projectImporter) check(pkg *goPackage) *types.Package {
+	if tp, ok := imp.checked[pkg]; ok { return tp } // nil pendant le check : cycle d'imports
+	imp.checked[pkg] = nil
+	conf := types.Config{Importer: imp, Error: func(error) {}} // on veut les Uses même si le package ne compile pas
+	tp, _ := conf.Check(pkg.Dir, imp.fset, pkg.Files, imp.info)
+	imp.checked[pkg], imp.ours[tp] = tp, true
+	return tp
+}
 
-	for {
-		fmt.Printf("%s%s❯%s ", Bold, Blue, Reset)
-		if !scanner.Scan() { break }
-		input := scanner.Text()
+func (imp *projectImporter) Import(p string) (*types.Package, error) { return imp.ImportFrom(p, ".", 0) }
 
-		if input == "/q" { break }
-		
-		// --- COMMANDE /i : ANALYSE ET SAUVEGARDE ---
-		if input == "/i" {
-			guidelines := analyzeProject()
-			if guidelines != "" {
-				header := fmt.Sprintf("\n\n### AUTO-ANALYSIS (%s) ###\n", time.Now().Format("2006-01-02 15:04"))
-				
-				// Ajout à agents.md
-				f, err := os.OpenFile("agents.md", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if err == nil {
-					f.WriteString(header + guidelines)
-					f.Close()
-					fmt.Printf("%s[agents.md updated on disk]%s\n", Green, Reset)
-				} else {
-					fmt.Printf("%sError writing agents.md: %v%s\n", Red, err, Reset)
-				}
+func (imp *projectImporter) ImportFrom(p, dir string, mode types.ImportMode) (*types.Package, error) {
+	if pkg := imp.byPath[p]; pkg != nil {
+		if tp := imp.check(pkg); tp != nil { return tp, nil }
+		return nil, fmt.Errorf("import cycle through %s", p)
+	}
+	goExternalMu.Lock()
+	defer goExternalMu.Unlock()
+	if goExternal == nil { goExternal = importer.ForCompiler(token.NewFileSet(), "source", nil).(types.ImporterFrom) }
+	return goExternal.ImportFrom(p, dir, mode)
+}
 
-				// Rechargement immédiat du cerveau
-				sysPrompt = getSystemPrompt(cwd)
-				history = []Message{{Role: "system", Content: sysPrompt}}
-				fmt.Printf("%sContext reloaded from agents.md.%s\n", Green, Reset)
-			}
-			continue
+func positionKey(p token.Position) string {
+	abs, _ := filepath.Abs(p.Filename)
+	return fmt.Sprintf("%s:%d:%d", abs, p.Line, p.Column)
+}
+
+// --- LSP (serveurs de langage sur stdio) ---
+
+const (
+	LSPStartTimeout = 30 * time.Second
+	LSPCallTimeout  = 30 * time.Second
+	LSPDiagWait     = 5 * time.Second // attente max des diagnostics après une modification
+	LSPDiagQuiet    = 300 * time.Millisecond
+	LSPMaxResults   = 200
+	LSPMaxDiags     = 30 // diagnostics ajoutés au résultat de write
+)
+
+type LSPServer struct {
+	Command    []string `json:"command"`     // ex. ["gopls"], ["pyright-langserver", "--stdio"]
+	Extensions []string `json:"extensions"`  // ex. [".go"]
+	LanguageID string   `json:"language_id"` // défaut déduit de l'extension
+}
+
+type lspPos struct {
+	Line      int `json:"line"`      // à partir de 0
+	Character int `json:"character"` // unités UTF-16
+}
+
+type lspRange struct {
+	Start lspPos `json:"start"`
+	End   lspPos `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"` // 1 erreur, 2 warning, 3 info, 4 hint
+	Message  string   `json:"message"`
+	Source   string   `json:"source"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspReply struct {
+	Result json.RawMessage
+	Err    error
+}
+
+type lspClient struct {
+	name    string
+	conf    LSPServer
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	stderr  *shell.Buffer
+	writeMu sync.Mutex
+	openMu  sync.Mutex // didOpen/didChange partent dans l'ordre des versions (outils lsp_* en parallèle)
+	dead    chan struct{}
+
+	mu        sync.Mutex
+	nextID    int
+	pending   map[int]chan lspReply
+	versions  map[string]int             // uri -> version des documents ouverts
+	diags     map[string][]lspDiagnostic // uri -> derniers diagnostics publiés
+	published map[string]int             // uri -> numéro de la dernière publication
+	seq       int
+	lastDiag  time.Time
+}
+
+// lspSlot : un serveur par ligne de commande. ready est fermé une fois le démarrage terminé (c ou err) ;
+// un serveur qui n'a pas démarré garde son erreur : on ne réessaie pas.
+type lspSlot struct {
+	ready chan struct{}
+	c     *lspClient
+	err   error
+}
+
+var (
+	lspMu    sync.Mutex // ne protège que la table : le démarrage (jusqu'à LSPStartTimeout) se fait hors verrou
+	lspSlots = map[string]*lspSlot{} // clé : ligne de commande
+)
+
+var lspLanguages = map[string]string{
+	".py": "python", ".js": "javascript", ".jsx": "javascriptreact", ".ts": "typescript", ".tsx": "typescriptreact",
+	".rs": "rust", ".rb": "ruby", ".h": "c", ".hpp": "cpp", ".cc": "cpp", ".cs": "csharp", ".kt": "kotlin",
+}
+
+func fileURI(abs string) string {
+	p := filepath.ToSlash(abs)
+	if !strings.HasPrefix(p, "/") { p = "/" + p } // C:/x -> /C:/x
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" { return uri }
+	p := u.Path
+	if runtime.GOOS == "windows" { p = strings.TrimPrefix(p, "/") }
+	return filepath.FromSlash(p)
+}
+
+// lspFor renvoie le serveur configuré pour l'extension de path (nil, nil si aucun), démarré à la demande.
+func lspFor(path string) (*lspClient, error) {
+	ext := filepath.Ext(path)
+	for _, conf := range Cfg.LSP {
+		if len(conf.Command) == 0 || !slices.Contains(conf.Extensions, ext) { continue }
+		key := strings.Join(conf.Command, " ")
+		lspMu.Lock()
+		slot := lspSlots[key]
+		if slot != nil && slot.crashed() { slot = nil } // planté : on le relance
+		start := slot == nil
+		if start {
+			slot = &lspSlot{ready: make(chan struct{})}
+			lspSlots[key] = slot
 		}
+		lspMu.Unlock()
 
-		if input == "/c" {
-			sysPrompt = getSystemPrompt(cwd) // Relecture fraiche du fichier
-			history = []Message{{Role: "system", Content: sysPrompt}}
-			fmt.Printf("%sCleaned & Memory Reloaded.%s\n", Green, Reset)
-			continue
+		if !start {
+			<-slot.ready // démarré par un autre appel : on attend la fin de sa poignée de main
+			return slot.c, slot.err
 		}
+		c, err := startLSP(conf)
+		lspMu.Lock()
+		if lspSlots[key] != slot && c != nil { // closeLSP est passé pendant le démarrage
+			c.Close()
+			c, err = nil, errors.New(conf.Command[0] + ": language servers closed")
+		}
+		slot.c, slot.err = c, err
+		lspMu.Unlock()
+		close(slot.ready)
+		return c, err
+	}
+	return nil, nil
+}
+
+// crashed : le serveur a démarré puis s'est arrêté. À appeler sous lspMu (c n'est écrit que sous lspMu).
+func (s *lspSlot) crashed() bool {
+	if s.c == nil { return false } // en cours de démarrage, ou en échec
+	select {
+	case <-s.c.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// runningLSPs renvoie les serveurs démarrés, sans attendre ceux qui démarrent encore.
+func runningLSPs() []*lspClient {
+	lspMu.Lock()
+	defer lspMu.Unlock()
+	var clients []*lspClient
+	for _, slot := range lspSlots {
+		if slot.c != nil { clients = append(clients, slot.c) }
+	}
+	return clients
+}
 
-		history = append(history, Message{Role: "user", Content: input})
+func startLSP(conf LSPServer) (*lspClient, error) {
+	cwd, _ := os.Getwd()
+	root := repoRoot(cwd)
+	c := &lspClient{
+		name: filepath.Base(conf.Command[0]), conf: conf, dead: make(chan struct{}), stderr: shell.NewBuffer(4000),
+		pending: map[int]chan lspReply{}, versions: map[string]int{}, diags: map[string][]lspDiagnostic{}, published: map[string]int{},
+	}
+	c.cmd = exec.Command(conf.Command[0], conf.Command[1:]...)
+	shell.SetProcessGroup(c.cmd) // hors du groupe du terminal : un Ctrl-C ne doit pas obliger à tout réindexer
+	c.cmd.Dir = root
+	c.cmd.Stderr = c.stderr
+	in, err := c.cmd.StdinPipe()
+	if err != nil { return nil, err }
+	out, err := c.cmd.StdoutPipe()
+	if err != nil { return nil, err }
+	c.in = in
+	if err := c.cmd.Start(); err != nil { return nil, fmt.Errorf("%s: %v", c.name, err) }
+	go c.readLoop(bufio.NewReader(out))
 
-		// --- BOUCLE ORCHESTRATEUR ---
+	ctx, cancel := context.WithTimeout(context.Background(), LSPStartTimeout)
+	defer cancel()
+	_, err = c.call(ctx, "initialize", map[string]interface{}{
+		"processId": os.Getpid(),
+		"rootUri":   fileURI(root),
+		"workspaceFolders": []map[string]string{{"uri": fileURI(root), "name": filepath.Base(root)}},
+		"capabilities": map[string]interface{}{
+			"general":   map[string]interface{}{"positionEncodings": []string{"utf-16"}},
+			"workspace": map[string]interface{}{"configuration": true, "workspaceFolders": true, "workspaceEdit": map[string]interface{}{"documentChanges": true}},
+			"textDocument": map[string]interface{}{
+				"synchronization":    map[string]interface{}{"didSave": true},
+				"publishDiagnostics": map[string]interface{}{"versionSupport": true},
+				"definition":         map[string]interface{}{"linkSupport": true},
+				"references":         map[string]interface{}{},
+				"rename":             map[string]interface{}{},
+			},
+		},
+	})
+	if err != nil {
+		c.kill()
+		return nil, fmt.Errorf("%s initialize: %v %s", c.name, err, strings.TrimSpace(c.stderr.String()))
+	}
+	c.notify("initialized", map[string]interface{}{})
+	return c, nil
+}
+
+func (c *lspClient) send(msg map[string]interface{}) error {
+	msg["jsonrpc"] = "2.0"
+	body, _ := json.Marshal(msg)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (c *lspClient) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+func (c *lspClient) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	ch := make(chan lspReply, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	if err := c.send(map[string]interface{}{"id": id, "method": method, "params": params}); err != nil { return nil, err }
+	select {
+	case r := <-ch:
+		return r.Result, r.Err
+	case <-c.dead:
+		return nil, fmt.Errorf("%s exited %s", c.name, strings.TrimSpace(c.stderr.String()))
+	case <-ctx.Done():
+		c.notify("$/cancelRequest", map[string]int{"id": id})
+		return nil, ctx.Err()
+	}
+}
+
+func (c *lspClient) readLoop(r *bufio.Reader) {
+	defer func() {
+		c.cmd.Wait()
+		close(c.dead)
+	}()
+	for {
+		n := -1
 		for {
-			content, tools, err := callMistralStream(history)
-			if err != nil { fmt.Printf("%sError: %v%s\n", Red, err, Reset); break }
-
-			history = append(history, Message{Role: "assistant", Content: content, ToolCalls: tools})
-
-			if len(tools) > 0 {
-				for _, tool := range tools {
-					fname := tool.Function.Name
-					fmt.Printf("%s[EXEC: %s]%s\n", Green, strings.ToUpper(fname), Reset)
-					
-					var args map[string]interface{}
-					json.Unmarshal([]byte(tool.Function.Arguments), &args)
-					
-					var res string
-					switch fname {
-					case "read": res = toolRead(args)
-					case "write": res = toolWrite(args)
-					case "bash": res = toolBash(args)
-					case "glob": res = toolGlob(args)
-					default: res = "unknown tool"
-					}
-					
-					preview := strings.ReplaceAll(res, "\n", " ")
-					if len(preview) > 60 { preview = preview[:60] + "..." }
-					fmt.Printf("%s⎿ %s%s\n", Dim, preview, Reset)
-					
-					history = append(history, Message{Role: "tool", ToolCallID: tool.ID, Name: fname, Content: res})
-				}
-				fmt.Printf("%s(🔄 Orchestrator analyzing result...)%s\n", Yellow, Reset)
-				continue
+			line, err := r.ReadString('\n')
+			if err != nil { return }
+			line = strings.TrimSpace(line)
+			if line == "" { break }
+			if v, ok := strings.CutPrefix(line, "Content-Length:"); ok { n, _ = strconv.Atoi(strings.TrimSpace(v)) }
+		}
+		if n < 0 { continue }
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil { return }
+		var msg struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &msg) != nil { continue }
+		switch {
+		case msg.Method == "textDocument/publishDiagnostics":
+			var p struct {
+				URI         string          `json:"uri"`
+				Diagnostics []lspDiagnostic `json:"diagnostics"`
 			}
-			break
+			if json.Unmarshal(msg.Params, &p) != nil { continue }
+			c.mu.Lock()
+			c.seq++
+			c.diags[p.URI] = p.Diagnostics
+			c.published[p.URI] = c.seq
+			c.lastDiag = time.Now()
+			c.mu.Unlock()
+		case msg.Method != "" && msg.ID != nil:
+			// requête du serveur : réponse neutre (configuration vide, progression acceptée...)
+			var result interface{}
+			if msg.Method == "workspace/configuration" {
+				var p struct{ Items []interface{} `json:"items"` }
+				json.Unmarshal(msg.Params, &p)
+				result = make([]interface{}, len(p.Items))
+			}
+			c.send(map[string]interface{}{"id": msg.ID, "result": result})
+		case msg.Method == "" && msg.ID != nil:
+			var id int
+			if json.Unmarshal(msg.ID, &id) != nil { continue }
+			c.mu.Lock()
+			ch := c.pending[id]
+			c.mu.Unlock()
+			if ch == nil { continue }
+			if msg.Error != nil {
+				ch <- lspReply{Err: fmt.Errorf("%s", msg.Error.Message)}
+			} else {
+				ch <- lspReply{Result: msg.Result}
+			}
+		}
+	}
+}
+
+func (c *lspClient) kill() {
+	c.in.Close()
+	select {
+	case <-c.dead:
+	case <-time.After(time.Second):
+		shell.KillProcessGroup(c.cmd)
+		<-c.dead
+	}
+}
+
+func (c *lspClient) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c.call(ctx, "shutdown", nil)
+	c.notify("exit", nil)
+	c.kill()
+}
+
+// closeLSP arrête les serveurs démarrés ; ceux qui démarrent encore s'arrêtent à la fin de leur
+// démarrage (lspFor voit qu'ils ont quitté la table).
+func closeLSP() {
+	lspMu.Lock()
+	var clients []*lspClient
+	for _, slot := range lspSlots {
+		if slot.c != nil { clients = append(clients, slot.c) }
+	}
+	clear(lspSlots)
+	lspMu.Unlock()
+	for _, c := range clients { c.Close() }
+}
+
+// open envoie le contenu actuel du fichier au serveur (didOpen la première fois, didChange ensuite)
+// et renvoie le numéro de publication à dépasser pour avoir des diagnostics à jour.
+func (c *lspClient) open(path string) (string, int, error) {
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+	abs, _ := filepath.Abs(path)
+	data, err := os.ReadFile(abs)
+	if err != nil { return "", 0, err }
+	uri := fileURI(abs)
+	c.mu.Lock()
+	since := c.published[uri]
+	v, opened := c.versions[uri]
+	c.versions[uri] = v + 1
+	c.mu.Unlock()
+	if !opened {
+		lang := c.conf.LanguageID
+		if lang == "" { lang = lspLanguages[filepath.Ext(abs)] }
+		if lang == "" { lang = strings.TrimPrefix(filepath.Ext(abs), ".") }
+		c.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "languageId": lang, "version": 1, "text": string(data)}})
+	} else {
+		c.notify("textDocument/didChange", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "version": v + 1}, "contentChanges": []map[string]string{{"text": string(data)}}})
+		c.notify("textDocument/didSave", map[string]interface{}{"textDocument": map[string]string{"uri": uri}})
+	}
+	return uri, since, nil
+}
+
+// waitDiagnostics attend une publication pour uri plus récente que since, puis que le serveur se calme.
+// Un fichier déjà diagnostiqué peut ne pas être republié s'il n'a pas changé : on attend alors moins.
+func (c *lspClient) waitDiagnostics(uri string, since int) {
+	wait := LSPDiagWait
+	if since > 0 { wait = LSPDiagWait / 3 }
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		fresh, quiet := c.published[uri] > since, time.Since(c.lastDiag) > LSPDiagQuiet
+		c.mu.Unlock()
+		if fresh && quiet { return }
+		select {
+		case <-c.dead:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// report formate les diagnostics retenus par keep, triés par fichier puis ligne.
+func (c *lspClient) report(keep func(uri string, d lspDiagnostic) bool) []string {
+	c.mu.Lock()
+	var uris []string
+	for uri := range c.diags { uris = append(uris, uri) }
+	sort.Strings(uris)
+	var out []string
+	for _, uri := range uris {
+		ds := slices.Clone(c.diags[uri])
+		sort.SliceStable(ds, func(i, j int) bool { return ds[i].Range.Start.Line < ds[j].Range.Start.Line })
+		var lines []string
+		for _, d := range ds {
+			if !keep(uri, d) { continue }
+			if lines == nil { lines = fileLines(uriPath(uri)) }
+			sev := [...]string{"error", "error", "warning", "info", "hint"}[min(max(d.Severity, 0), 4)]
+			msg := strings.ReplaceAll(strings.TrimSpace(d.Message), "\n", " ")
+			if d.Source != "" { msg += " (" + d.Source + ")" }
+			out = append(out, fmt.Sprintf("%s: %s: %s", lspLocation(uri, d.Range.Start, lines), sev, msg))
 		}
+	}
+	c.mu.Unlock()
+	return out
+}
+
+func fileLines(path string) []string {
+	data, _ := os.ReadFile(path)
+	return strings.Split(string(data), "\n")
+}
+
+// lspLocation affiche une position LSP en chemin:ligne:colonne (1-based, colonne en octets).
+func lspLocation(uri string, p lspPos, lines []string) string {
+	cwd, _ := os.Getwd()
+	col := p.Character + 1
+	if p.Line < len(lines) { col = utf16ToByte(lines[p.Line], p.Character) + 1 }
+	return fmt.Sprintf("%s:%d:%d", displayPath(cwd, uriPath(uri)), p.Line+1, col)
+}
+
+func utf16ToByte(line string, units int) int {
+	n := 0
+	for i, r := range line {
+		if n >= units { return i }
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func byteToUTF16(line string, col int) int {
+	return len(utf16.Encode([]rune(line[:min(col, len(line))])))
+}
+
+// lspAfterWrite renvoie les diagnostics du fichier écrit, et ceux apparus ailleurs à cause de l'écriture.
+func lspAfterWrite(path string) string {
+	c, _ := lspFor(path)
+	if c == nil { return "" }
+	type key struct {
+		uri, msg string
+		line     int
+	}
+	before := map[key]bool{}
+	c.report(func(uri string, d lspDiagnostic) bool {
+		before[key{uri, d.Message, d.Range.Start.Line}] = true
+		return false
+	})
+	uri, since, err := c.open(path)
+	if err != nil { return "" }
+	c.waitDiagnostics(uri, since)
+	lines := c.report(func(u string, d lspDiagnostic) bool {
+		return d.Severity <= 2 && (u == uri || !before[key{u, d.Message, d.Range.Start.Line}])
+	})
+	if len(lines) == 0 { return "" }
+	if len(lines) > LSPMaxDiags { lines = append(lines[:LSPMaxDiags], fmt.Sprintf("... (%d more)", len(lines)-LSPMaxDiags)) }
+	return "\n\nDiagnostics (" + c.name + "):\n" + strings.Join(lines, "\n")
+}
+
+// lspTarget désigne une position : ligne (à partir de 1) et texte du symbole sur cette ligne, ou colonne.
+type lspTarget struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Symbol string `json:"symbol,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+type lspRenameArgs struct {
+	lspTarget
+	NewName string `json:"new_name"`
+}
+
+// lspAt ouvre le fichier visé et calcule la position LSP.
+func lspAt(a lspTarget) (*lspClient, map[string]interface{}, error) {
+	path := a.Path
+	if path == "" { return nil, nil, errors.New("path missing") }
+	c, err := lspFor(path)
+	if err != nil { return nil, nil, err }
+	if c == nil { return nil, nil, errors.New("no language server configured for " + filepath.Ext(path) + " files") }
+	line := a.Line
+	lines := fileLines(path)
+	if line < 1 || line > len(lines) { return nil, nil, fmt.Errorf("line must be between 1 and %d", len(lines)) }
+	text := lines[line-1]
+	col := -1
+	if sym := a.Symbol; sym != "" {
+		loc := regexp.MustCompile(`\b` + regexp.QuoteMeta(sym) + `\b`).FindStringIndex(text)
+		if loc == nil { loc = regexp.MustCompile(regexp.QuoteMeta(sym)).FindStringIndex(text) }
+		if loc == nil { return nil, nil, fmt.Errorf("%q not found on line %d: %s", sym, line, strings.TrimSpace(text)) }
+		col = loc[0]
+	} else if a.Column >= 1 {
+		col = a.Column - 1
+	}
+	if col < 0 { return nil, nil, errors.New("give symbol (text on that line) or column") }
+	uri, _, err := c.open(path)
+	if err != nil { return nil, nil, err }
+	return c, map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     lspPos{Line: line - 1, Character: byteToUTF16(text, col)},
+	}, nil
+}
+
+// formatLocations accepte Location, []Location ou []LocationLink.
+func formatLocations(raw json.RawMessage) string {
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		if string(raw) == "null" || len(raw) == 0 { return "No results" }
+		list = []json.RawMessage{raw}
+	}
+	var out []string
+	files := map[string][]string{}
+	for _, item := range list {
+		var loc struct {
+			URI       string   `json:"uri"`
+			Range     lspRange `json:"range"`
+			TargetURI string   `json:"targetUri"`
+			Target    lspRange `json:"targetSelectionRange"`
+		}
+		if json.Unmarshal(item, &loc) != nil { continue }
+		if loc.TargetURI != "" { loc.URI, loc.Range = loc.TargetURI, loc.Target }
+		if loc.URI == "" { continue }
+		lines, ok := files[loc.URI]
+		if !ok {
+			lines = fileLines(uriPath(loc.URI))
+			files[loc.URI] = lines
+		}
+		s := lspLocation(loc.URI, loc.Range.Start, lines)
+		if l := loc.Range.Start.Line; l < len(lines) { s += ": " + strings.TrimSpace(lines[l]) }
+		out = append(out, s)
+		if len(out) == LSPMaxResults {
+			out = append(out, fmt.Sprintf("... (%d more)", len(list)-LSPMaxResults))
+			break
+		}
+	}
+	if len(out) == 0 { return "No results" }
+	return strings.Join(out, "\n")
+}
+
+func toolLSPDiagnostics(_ context.Context, a optPathArgs) (string, error) {
+	path := a.Path
+	if path == "" {
+		var out []string
+		for _, c := range runningLSPs() { out = append(out, c.report(func(string, lspDiagnostic) bool { return true })...) }
+		if len(out) == 0 { return "No diagnostics (only files opened so far are checked; pass a path)", nil }
+		return strings.Join(out, "\n"), nil
+	}
+	c, err := lspFor(path)
+	if err != nil { return "", err }
+	if c == nil { return "", errors.New("no language server configured for " + filepath.Ext(path) + " files") }
+	uri, since, err := c.open(path)
+	if err != nil { return "", err }
+	c.waitDiagnostics(uri, since)
+	out := c.report(func(u string, _ lspDiagnostic) bool { return u == uri })
+	if len(out) == 0 { return "No diagnostics", nil }
+	return strings.Join(out, "\n"), nil
+}
+
+func toolLSPDefinition(ctx context.Context, a lspTarget) (string, error) {
+	c, params, err := lspAt(a)
+	if c == nil { return "", err }
+	ctx, cancel := context.WithTimeout(ctx, LSPCallTimeout)
+	defer cancel()
+	raw, err := c.call(ctx, "textDocument/definition", params)
+	if err != nil { return "", err }
+	return formatLocations(raw), nil
+}
+
+func toolLSPReferences(ctx context.Context, a lspTarget) (string, error) {
+	c, params, err := lspAt(a)
+	if c == nil { return "", err }
+	params["context"] = map[string]bool{"includeDeclaration": true}
+	ctx, cancel := context.WithTimeout(ctx, LSPCallTimeout)
+	defer cancel()
+	raw, err := c.call(ctx, "textDocument/references", params)
+	if err != nil { return "", err }
+	return formatLocations(raw), nil
+}
+
+func toolLSPRename(ctx context.Context, a lspRenameArgs) (string, error) {
+	newName := a.NewName
+	if newName == "" { return "", errors.New("new_name missing") }
+	c, params, err := lspAt(a.lspTarget)
+	if c == nil { return "", err }
+	params["newName"] = newName
+	ctx, cancel := context.WithTimeout(ctx, LSPCallTimeout)
+	defer cancel()
+	raw, err := c.call(ctx, "textDocument/rename", params)
+	if err != nil { return "", err }
+	var we struct {
+		Changes         map[string][]lspTextEdit `json:"changes"`
+		DocumentChanges []struct {
+			Kind         string `json:"kind"`
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Edits []lspTextEdit `json:"edits"`
+		} `json:"documentChanges"`
+	}
+	if err := json.Unmarshal(raw, &we); err != nil { return "", err }
+	edits := we.Changes
+	if edits == nil { edits = map[string][]lspTextEdit{} }
+	for _, dc := range we.DocumentChanges {
+		if dc.Kind != "" { return "", errors.New("rename needs file operations (" + dc.Kind + "), not supported") }
+		edits[dc.TextDocument.URI] = append(edits[dc.TextDocument.URI], dc.Edits...)
+	}
+	if len(edits) == 0 { return "Nothing to rename", nil }
+
+	var out []string
+	uris := slices.Sorted(maps.Keys(edits))
+	for _, uri := range uris {
+		path := uriPath(uri)
+		data, err := os.ReadFile(path)
+		if err != nil { return "", err }
+		text := string(data)
+		es := edits[uri]
+		sort.SliceStable(es, func(i, j int) bool { // de la fin vers le début : les offsets restent valides
+			a, b := es[i].Range.Start, es[j].Range.Start
+			return a.Line > b.Line || (a.Line == b.Line && a.Character > b.Character)
+		})
+		for _, e := range es {
+			start, end := lspOffset(text, e.Range.Start), lspOffset(text, e.Range.End)
+			if start > end { return "", errors.New("invalid edit range from language server") }
+			text = text[:start] + e.NewText + text[end:]
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil { return "", err }
+		c.open(path)
+		cwd, _ := os.Getwd()
+		out = append(out, fmt.Sprintf("%s (%d edits)", displayPath(cwd, path), len(es)))
+	}
+	return "Renamed to " + newName + " in:\n" + strings.Join(out, "\n"), nil
+}
+
+// lspOffset convertit une position LSP en offset d'octets dans text.
+func lspOffset(text string, p lspPos) int {
+	off := 0
+	for i := 0; i < p.Line; i++ {
+		nl := strings.IndexByte(text[off:], '\n')
+		if nl < 0 { return len(text) }
+		off += nl + 1
+	}
+	line := text[off:]
+	if nl := strings.IndexByte(line, '\n'); nl >= 0 { line = line[:nl] }
+	return off + utf16ToByte(line, p.Character)
+}
+
+// --- MCP (internal/mcp, partagé avec nanocode-gemini.go) ---
+
+var mcpServers = &mcp.Set{} // vide tant que startMCP n'a pas tourné
+
+// startMCP connecte en parallèle les serveurs de la config et affiche leur état.
+func startMCP() {
+	mcpServers = mcp.Start(Cfg.MCPServers, func(msg string) { fmt.Printf("%s%s%s\n", Dim, msg, Reset) })
+	for _, c := range mcpServers.Clients {
+		if c.Err != nil {
+			fmt.Printf("%sWarning: MCP server %s unavailable: %v%s\n", Yellow, c.Name, c.Err, Reset)
+		} else {
+			fmt.Printf("%sMCP server %s: %d tools%s\n", Dim, c.Name, len(c.Listed()), Reset)
+		}
+	}
+}
+
+func closeMCP() { mcpServers.Close() }
+
+func cmdMCP(*Session, string) (string, bool) {
+	if len(mcpServers.Clients) == 0 {
+		fmt.Printf("%sNo MCP servers (add mcp_servers to .nanocode/config.json)%s\n", Dim, Reset)
+		return "", false
+	}
+	for _, c := range mcpServers.Clients {
+		kind := "stdio"
+		if c.Conf.URL != "" { kind = c.Conf.URL }
+		if c.Err != nil {
+			fmt.Printf("%s%s%s (%s) %sunavailable: %v%s\n", Bold, c.Name, Reset, kind, Red, c.Err, Reset)
+			continue
+		}
+		tools := c.Listed()
+		fmt.Printf("%s%s%s (%s) %d tools\n", Bold, c.Name, Reset, kind, len(tools))
+		for _, t := range tools {
+			desc, _, _ := strings.Cut(t.Description, "\n")
+			fmt.Printf("  %s%s%s %s%s%s\n", Green, mcp.ToolName(c.Name, t.Name), Reset, Dim, desc, Reset)
+		}
+	}
+	return "", false
+}
+
+// --- JOBS (ARRIÈRE-PLAN) ---
+
+const JobOutputCap = 200000 // octets gardés par job (les plus récents)
+
+// jobBuffer garde la fin de la sortie d'un job et se souvient de ce qui a déjà été lu.
+type jobBuffer struct {
+	mu   sync.Mutex
+	data []byte
+	base int // offset absolu de data[0]
+	read int // offset absolu déjà renvoyé au modèle
+}
+
+func (b *jobBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if over := len(b.data) - JobOutputCap; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+		b.base += over
+	}
+	return len(p), nil
+}
+
+// Next renvoie la sortie produite depuis le dernier appel, et le nombre d'octets perdus entre-temps.
+func (b *jobBuffer) Next() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lost := 0
+	if b.read < b.base { lost = b.base - b.read; b.read = b.base }
+	out := string(b.data[b.read-b.base:])
+	b.read = b.base + len(b.data)
+	return out, lost
+}
+
+type Job struct {
+	ID       int
+	Cmd      string
+	Started  time.Time
+	cmd      *exec.Cmd
+	out      *jobBuffer
+	done     chan struct{}
+	exitCode int
+}
+
+func (j *Job) Status() string {
+	select {
+	case <-j.done:
+		return fmt.Sprintf("exited (code %d)", j.exitCode)
+	default:
+		return fmt.Sprintf("running (%s)", time.Since(j.Started).Round(time.Second))
+	}
+}
+
+var (
+	jobsMu    sync.Mutex
+	jobs      = map[int]*Job{}
+	nextJobID = 1
+)
+
+func startJob(cmdStr, dir string) (*Job, error) {
+	cmd, err := shellCommand(context.Background(), dir, "bash", "-c", cmdStr)
+	if err != nil { return nil, err }
+	shell.SetProcessGroup(cmd)
+	shell.DieWithParent(cmd) // un serveur de dev ne doit pas survivre à nanocode
+	out := &jobBuffer{}
+	cmd.Stdout = out; cmd.Stderr = out
+	if err := cmd.Start(); err != nil { return nil, err }
+
+	jobsMu.Lock()
+	j := &Job{ID: nextJobID, Cmd: cmdStr, Started: time.Now(), cmd: cmd, out: out, done: make(chan struct{})}
+	jobs[j.ID] = j
+	nextJobID++
+	jobsMu.Unlock()
+
+	go func() {
+		cmd.Wait()
+		j.exitCode = cmd.ProcessState.ExitCode()
+		close(j.done)
+	}()
+	return j, nil
+}
+
+type jobArgs struct {
+	ID int `json:"id"`
+}
+
+type jobStartArgs struct {
+	Cmd string `json:"cmd"`
+	Cwd string `json:"cwd,omitempty"`
+}
+
+func getJob(id int) (*Job, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	if !ok { return nil, fmt.Errorf("no job %d", id) }
+	return j, nil
+}
+
+func listJobs() string {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if len(jobs) == 0 { return "No jobs" }
+	ids := make([]int, 0, len(jobs))
+	for id := range jobs { ids = append(ids, id) }
+	sort.Ints(ids)
+	var sb strings.Builder
+	for _, id := range ids {
+		j := jobs[id]
+		sb.WriteString(fmt.Sprintf("[%d] %s  %s\n", j.ID, j.Status(), j.Cmd))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// killAllJobs est appelé à la sortie de nanocode : aucun serveur de dev ne doit survivre.
+func killAllJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		default:
+			shell.KillProcessGroup(j.cmd)
+		}
+	}
+}
+
+func toolJobStart(_ context.Context, a jobStartArgs) (string, error) {
+	if a.Cmd == "" { return "", errors.New("cmd missing") }
+	j, err := startJob(a.Cmd, a.Cwd)
+	if err != nil { return "", err }
+	return fmt.Sprintf("Started job %d", j.ID), nil
+}
+
+func toolJobOutput(_ context.Context, a jobArgs) (string, error) {
+	j, err := getJob(a.ID)
+	if j == nil { return "", err }
+	out, lost := j.out.Next()
+	res := fmt.Sprintf("[job %d: %s]", j.ID, j.Status())
+	if lost > 0 { res += fmt.Sprintf("\n...[%d bytes dropped]...", lost) }
+	out = strings.TrimRight(out, "\n")
+	if out == "" { return res + "\n(no new output)", nil }
+	return res + "\n" + out, nil
+}
+
+// jobStatusArgs : sans id (0), tous les jobs.
+type jobStatusArgs struct {
+	ID int `json:"id,omitempty"`
+}
+
+func toolJobStatus(_ context.Context, a jobStatusArgs) (string, error) {
+	if a.ID == 0 { return listJobs(), nil }
+	j, err := getJob(a.ID)
+	if j == nil { return "", err }
+	return fmt.Sprintf("[%d] %s  %s", j.ID, j.Status(), j.Cmd), nil
+}
+
+func toolJobKill(_ context.Context, a jobArgs) (string, error) {
+	j, err := getJob(a.ID)
+	if j == nil { return "", err }
+	select {
+	case <-j.done:
+		return fmt.Sprintf("Job %d already %s", j.ID, j.Status()), nil
+	default:
+	}
+	if err := shell.KillProcessGroup(j.cmd); err != nil { return "", err }
+	select {
+	case <-j.done:
+	case <-time.After(3 * time.Second):
+	}
+	return fmt.Sprintf("Killed job %d", j.ID), nil
+}
+
+// --- REGISTRE D'OUTILS ---
+
+// Le registre et la validation des arguments sont dans internal/tool, partagés avec nanocode-gemini.go.
+
+var registry tool.Registry
+
+// registerTools remplit le registre ; à appeler après loadConfig (descriptions et outils LSP en dépendent).
+func registerTools() {
+	registry = tool.Registry{}
+	bashDesc := "Run shell cmd (timeout in seconds, default 120, max 600; optional cwd)"
+	if Cfg.Shell.Persistent { bashDesc += ". Persistent session: cd, exports and venvs carry over between calls; with cwd, the directory change lasts only for that call" }
+	if Cfg.Shell.Sandbox != "" && Cfg.Shell.Sandbox != "none" { bashDesc += ". Sandboxed: only the project dir is writable, no network" }
+	registry.Register(
+		tool.New("read", "Read file", toolRead),
+		tool.New("write", "Write file", toolWrite),
+		tool.New("edit", "Replace a string in a file. old must appear exactly once unless all=true", toolEdit),
+		tool.New("bash", bashDesc, toolBash),
+		tool.New("glob", "List files *", toolGlob),
+		tool.New("remember", "Save a durable project fact to agents.md (build/test command, convention, gotcha) so future sessions know it. Duplicates are ignored", toolRemember),
+		tool.New("search_code", "Search the project by concept or keywords (ranked, identifier-aware); returns file:line snippets. Use it before grepping blindly", toolSearchCode),
+		tool.New("go_symbols", "List exported Go symbols (with file:line and signature) of the package in a directory", toolGoSymbols),
+		tool.New("go_definition", "Find where a Go func, type, var, const or method is defined (name like Foo, Type.Method or pkg.Foo)", toolGoDefinition),
+		tool.New("go_references", "Find type-checked references to a Go symbol across the project, as file:line:col", toolGoReferences),
+		tool.New("job_start", "Start a long-running shell cmd in background (dev server, watcher), returns job id", toolJobStart),
+		tool.New("job_output", "Read new output of a background job since last read", toolJobOutput),
+		tool.New("job_status", "Status of a background job (all jobs if no id)", toolJobStatus),
+		tool.New("job_kill", "Kill a background job", toolJobKill),
+		tool.New("task", "Delegate a self-contained job (investigation, search across many files) to a sub-agent with a fresh context and its own tools; only its final summary comes back. The prompt must say everything it needs. Several read-only tasks in one reply run in parallel", toolTask),
+	)
+	if len(Cfg.LSP) > 0 {
+		registry.Register(
+			tool.New("lsp_diagnostics", "Compile errors and warnings from the language server for a file (or everything reported so far if no path)", toolLSPDiagnostics),
+			tool.New("lsp_definition", "Go to definition via the language server: path, 1-based line, and the symbol text on that line (or column)", toolLSPDefinition),
+			tool.New("lsp_references", "Find all references via the language server: path, 1-based line, and the symbol text on that line (or column)", toolLSPReferences),
+			tool.New("lsp_rename", "Rename a symbol across the project via the language server and apply the edits", toolLSPRename),
+		)
+	}
+	// Les outils externes ne peuvent pas remplacer un outil intégré
+	var plugins []string
+	for _, t := range loadPlugins() {
+		if registry.Lookup(t.Name()) != nil {
+			fmt.Printf("%sWarning: tool %s ignored: name already taken%s\n", Yellow, t.Name(), Reset)
+			continue
+		}
+		registry.Register(t)
+		plugins = append(plugins, t.Name())
+	}
+	if len(plugins) > 0 { fmt.Printf("%sPlugin tools: %s%s\n", Dim, strings.Join(plugins, ", "), Reset) }
+	registry.AddSource(func() []tool.Tool { return mcpServers.Tools() }) // startMCP peut venir après
+}
+
+// --- OUTILS EXTERNES (.nanocode/tools) ---
+
+// Un exécutable de .nanocode/tools/ est un outil : "--describe" écrit sa définition en JSON, puis
+// chaque appel reçoit les arguments en JSON sur stdin et répond en JSON sur stdout.
+const (
+	PluginDir             = ".nanocode/tools"
+	PluginDescribeTimeout = 10 * time.Second
+	PluginDefaultTimeout  = 120 * time.Second
+)
+
+var pluginNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type pluginTool struct {
+	path    string
+	name    string
+	desc    string
+	schema  map[string]interface{}
+	timeout time.Duration
+}
+
+func (t *pluginTool) Name() string                       { return t.name }
+func (t *pluginTool) Description() string                { return t.desc }
+func (t *pluginTool) Parameters() map[string]interface{} { return t.schema }
+
+func (t *pluginTool) Execute(parent context.Context, args map[string]interface{}) (string, error) {
+	if args == nil { args = map[string]interface{}{} }
+	if err := tool.Validate(t.schema, args); err != nil { return "", fmt.Errorf("invalid arguments for %s: %v", t.name, err) }
+	ctx, cancel := context.WithTimeout(parent, t.timeout)
+	defer cancel()
+	data, _ := json.Marshal(args)
+	cmd := exec.CommandContext(ctx, t.path)
+	shell.Prepare(cmd)
+	cmd.Env = append(os.Environ(), "NANOCODE_TOOL="+t.name)
+	cmd.Stdin = bytes.NewReader(data)
+	stdout, stderr := shell.NewBuffer(shell.OutputCap), shell.NewBuffer(4000)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	if parent.Err() != nil { return "", fmt.Errorf("%s stopped", t.name) }
+	if ctx.Err() == context.DeadlineExceeded { return "", fmt.Errorf("%s timed out after %s", t.name, t.timeout) }
+	out := strings.TrimSpace(stdout.String())
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" { msg = out }
+		return "", errors.New(strings.TrimSpace(fmt.Sprintf("%s failed (%v)\n%s", t.name, err, msg)))
+	}
+	// Réponse attendue : {"result": ...} ou {"error": "..."} ; tout autre texte est renvoyé tel quel
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if json.Unmarshal([]byte(out), &res) != nil || (res.Result == nil && res.Error == "") { return out, nil }
+	if res.Error != "" { return "", errors.New(res.Error) }
+	var s string
+	if json.Unmarshal(res.Result, &s) == nil { return s, nil }
+	var v interface{}
+	json.Unmarshal(res.Result, &v)
+	b, _ := json.MarshalIndent(v, "", "  ")
+	return string(b), nil
+}
+
+// isPluginExecutable : bit x sous Unix ; sous Windows, seules les extensions que le système sait lancer.
+func isPluginExecutable(e fs.DirEntry) bool {
+	info, err := e.Info()
+	if err != nil || !info.Mode().IsRegular() { return false }
+	if runtime.GOOS == "windows" {
+		return slices.Contains([]string{".exe", ".bat", ".cmd", ".com"}, strings.ToLower(filepath.Ext(e.Name())))
+	}
+	return info.Mode()&0111 != 0
+}
+
+// describePlugin lance "exe --describe" ; le nom par défaut est celui du fichier sans extension.
+func describePlugin(path string) (*pluginTool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PluginDescribeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "--describe")
+	shell.Prepare(cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil { return nil, fmt.Errorf("--describe failed: %s", strings.TrimSpace(fmt.Sprintf("%v %s", err, stderr.String()))) }
+	var d struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+		Timeout     int                    `json:"timeout"`
+	}
+	if err := json.Unmarshal(out, &d); err != nil { return nil, fmt.Errorf("--describe: invalid JSON: %v", err) }
+	t := &pluginTool{path: path, name: d.Name, desc: d.Description, schema: d.Parameters, timeout: PluginDefaultTimeout}
+	if t.name == "" { t.name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) }
+	if !pluginNameRe.MatchString(t.name) { return nil, fmt.Errorf("invalid tool name %q (letters, digits, _ and -, max 64)", t.name) }
+	if t.desc == "" { t.desc = t.name }
+	if t.schema == nil { t.schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}} }
+	if typ, _ := t.schema["type"].(string); typ != "object" { return nil, fmt.Errorf("parameters must be a JSON schema of type object") }
+	if d.Timeout > 0 { t.timeout = time.Duration(d.Timeout) * time.Second }
+	return t, nil
+}
+
+// loadPlugins décrit en parallèle les exécutables de PluginDir, dans l'ordre alphabétique.
+func loadPlugins() []tool.Tool {
+	entries, err := os.ReadDir(PluginDir)
+	if err != nil { return nil }
+	var paths []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") && isPluginExecutable(e) { paths = append(paths, filepath.Join(PluginDir, e.Name())) }
+	}
+	found := make([]*pluginTool, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, p := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if abs, err := filepath.Abs(p); err == nil { p = abs } // appelé ensuite depuis n'importe quel cwd
+			found[i], errs[i] = describePlugin(p)
+		}()
+	}
+	wg.Wait()
+	var tools []tool.Tool
+	for i, t := range found {
+		if errs[i] != nil {
+			fmt.Printf("%sWarning: tool %s ignored: %v%s\n", Yellow, paths[i], errs[i], Reset)
+			continue
+		}
+		tools = append(tools, t)
+	}
+	return tools
+}
+
+// --- MOTEUR IA (STREAMING) ---
+
+// streamChat s'arrête dès que ctx est annulé (Ctrl-C) et renvoie alors le texte déjà reçu.
+// Le texte est écrit sur out au fil de l'eau ; sans tools, le modèle doit répondre directement.
+func streamChat(ctx context.Context, messages []Message, tools []interface{}, out io.Writer) (string, []ToolCall, error) {
+	reqBody := RequestBody{
+		Model: CurrentModel, Messages: messages, Tools: tools, Temperature: 0.1, Stream: true,
+	}
+	if len(tools) > 0 { reqBody.ToolChoice = "auto" }
+	jsonBody, _ := json.Marshal(reqBody)
+	req, _ := http.NewRequestWithContext(ctx, "POST", MistralURL, bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+MistralKey)
+
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil { return "", nil, err }
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 { return "", nil, fmt.Errorf("API Error %s", resp.Status) }
+
+	reader := bufio.NewReader(resp.Body)
+	fullContent := ""
+	// Appels d'outils en cours de réception, par index ; un nouvel id sur un index déjà pris ouvre un autre appel
+	type pendingCall struct {
+		index int
+		call  ToolCall
+	}
+	var pending []*pendingCall
+	byIndex := map[int]*pendingCall{}
+	fmt.Fprintf(out, "%s", Magenta) // Pensée en violet
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil { break }
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data: ") { continue }
+		if line == "data: [DONE]" { break }
+		
+		var chunk StreamResponse
+		json.Unmarshal([]byte(line[6:]), &chunk)
+		
+		if len(chunk.Choices) > 0 {
+			delta := chunk.Choices[0].Delta
+			if delta.Content != "" {
+				fmt.Fprint(out, delta.Content)
+				fullContent += delta.Content
+			}
+			for _, tc := range delta.ToolCalls {
+				p := byIndex[tc.Index]
+				if p == nil || (tc.ID != "" && p.call.ID != "" && tc.ID != p.call.ID) {
+					p = &pendingCall{index: tc.Index, call: ToolCall{Type: "function"}}
+					pending = append(pending, p)
+					byIndex[tc.Index] = p
+				}
+				if tc.ID != "" { p.call.ID = tc.ID }
+				if tc.Function.Name != "" { p.call.Function.Name = tc.Function.Name }
+				p.call.Function.Arguments += tc.Function.Arguments
+			}
+		}
+	}
+	fmt.Fprintf(out, "%s\n", Reset)
+	if ctx.Err() != nil { return fullContent, nil, ctx.Err() } // appels d'outils incomplets : on les jette
+
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].index < pending[j].index })
+	var toolCalls []ToolCall
+	for _, p := range pending {
+		if p.call.ID != "" { toolCalls = append(toolCalls, p.call) }
+	}
+	return fullContent, toolCalls, nil
+}
+
+// --- GESTION CONTEXTE & ANALYSE ---
+
+// systemPrompt recompose le prompt système et repart de zéro pour les agents.md chargés.
+func (s *Session) systemPrompt() string {
+	cwd := s.Cwd
+	// 1. Base Prompt (Orchestrator Rules)
+	p := "You are the Orchestrator Agent. CWD: " + cwd + ".\n" +
+		"PROTOCOL: THOUGHT (Explain plan) > ACTION (Use tool) > OBSERVATION > REPEAT.\n" +
+		"Never use a tool without explaining WHY first in the THOUGHT phase."
+	
+	// 2. agents.md (Mémoire persistante) : global, puis de la racine du dépôt jusqu'au CWD
+	s.memMu.Lock()
+	s.memory = map[string]bool{}
+	s.memMu.Unlock()
+	for _, f := range agentsFiles(cwd) {
+		if data, err := os.ReadFile(f); err == nil {
+			s.markMemoryLoaded(f)
+			p += "\n\n=== [" + displayPath(cwd, f) + "] MEMORY & GUIDELINES ===\n" + string(data)
+		}
+	}
+
+	// 3. Contexte des hooks session_start
+	if s.hookContext != "" { p += "\n\n=== SESSION CONTEXT (hooks) ===\n" + s.hookContext }
+
+	// 4. Carte du dépôt (toujours en dernier : RefreshRepoMap la remplace sur place)
+	if m := repoMap.Get(); m != "" { p += RepoMapHeader + m }
+	return p
+}
+
+// markMemoryLoaded note f comme donné au modèle dans cette conversation ; false s'il l'était déjà.
+// Sans session (outil servi en MCP), chaque lecture redonne les consignes.
+func (s *Session) markMemoryLoaded(f string) bool {
+	if s == nil { return true }
+	s.memMu.Lock()
+	defer s.memMu.Unlock()
+	if s.memory == nil { s.memory = map[string]bool{} }
+	if s.memory[f] { return false }
+	s.memory[f] = true
+	return true
+}
+
+type sessionKey struct{}
+
+// sessionFrom renvoie la session dont le tour exécute l'outil (nil hors conversation).
+func sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+type toolsKey struct{}
+
+// toolsFrom renvoie les outils figés pour le tour du modèle en cours (registre complet hors tour) :
+// pas de nouvelle liste MCP à chaque appel d'outil.
+func toolsFrom(ctx context.Context) *tool.Registry {
+	if r, _ := ctx.Value(toolsKey{}).(*tool.Registry); r != nil { return r }
+	return &registry
+}
+
+// repoRoot remonte jusqu'au dossier qui contient .git ; sans dépôt, c'est dir lui-même.
+func repoRoot(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil { return d }
+		if d == filepath.Dir(d) { return dir }
+	}
+}
+
+// agentsFiles liste les agents.md qui s'appliquent à cwd, du plus général au plus précis.
+func agentsFiles(cwd string) []string {
+	files := []string{filepath.Join(userConfigDir(), "agents.md")}
+	root := repoRoot(cwd)
+	var dirs []string
+	for d := cwd; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root || d == filepath.Dir(d) { break }
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		files = append(files, filepath.Join(dirs[i], "agents.md"))
+	}
+	return files
+}
+
+func displayPath(cwd, f string) string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(f, filepath.Join(home, ".config")) {
+		return "~" + strings.TrimPrefix(f, home)
+	}
+	if rel, err := filepath.Rel(cwd, f); err == nil { return rel }
+	return f
+}
+
+// nestedAgents renvoie les agents.md pas encore chargés entre le dossier de path et la racine du dépôt,
+// pour que le modèle découvre les consignes d'un sous-dossier quand il y lit un fichier.
+func nestedAgents(ctx context.Context, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil { return "" }
+	cwd, _ := os.Getwd()
+	root := repoRoot(cwd)
+	if rel, err := filepath.Rel(root, abs); err != nil || strings.HasPrefix(rel, "..") { return "" }
+	var found []string
+	for d := filepath.Dir(abs); ; d = filepath.Dir(d) {
+		found = append([]string{filepath.Join(d, "agents.md")}, found...)
+		if d == root || d == filepath.Dir(d) { break }
+	}
+	var sb strings.Builder
+	for _, f := range found {
+		data, err := os.ReadFile(f)
+		if err != nil || !sessionFrom(ctx).markMemoryLoaded(f) { continue }
+		sb.WriteString("\n\n=== [" + displayPath(cwd, f) + "] GUIDELINES FOR THIS DIRECTORY ===\n" + string(data))
+	}
+	return sb.String()
+}
+
+// --- CARTE DU DÉPÔT ---
+
+const (
+	RepoMapHeader        = "\n\n=== REPO MAP (most referenced files first, trimmed) ===\n"
+	RepoMapDefaultTokens = 2000
+	RepoMapMaxFiles      = 3000
+	RepoMapMaxDirs       = 80 // au-delà, l'arbre seul mangerait le budget
+)
+
+// Déclarations de haut niveau pour les langages autres que Go (Go passe par go/parser).
+var declPatterns = map[string]*regexp.Regexp{
+	".py":   regexp.MustCompile(`^(?:async\s+)?(?:class|def)\s+(\w+)`),
+	".js":   regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:function\*?|class|const|let)\s+(\w+)`),
+	".ts":   regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:abstract\s+)?(?:async\s+)?(?:function\*?|class|interface|type|enum|const|let)\s+(\w+)`),
+	".rs":   regexp.MustCompile(`^(?:pub(?:\([\w:]+\))?\s+)?(?:async\s+)?(?:fn|struct|enum|trait|type|mod|const|static)\s+(\w+)`),
+	".java": regexp.MustCompile(`^(?:public\s+|protected\s+|private\s+)?(?:abstract\s+|final\s+|static\s+)*(?:class|interface|enum|record)\s+(\w+)`),
+	".rb":   regexp.MustCompile(`^\s*(?:class|module|def)\s+([\w:.]+)`),
+	".md":   regexp.MustCompile(`^#{1,2}\s+(.+)`),
+}
+
+func init() {
+	for _, ext := range []string{".jsx", ".mjs", ".cjs"} { declPatterns[ext] = declPatterns[".js"] }
+	declPatterns[".tsx"] = declPatterns[".ts"]
+	declPatterns[".kt"] = declPatterns[".java"]
+	declPatterns[".cs"] = declPatterns[".java"]
+}
+
+type mapFile struct {
+	rel    string
+	size   int64
+	mtime  int64
+	decls  []goDecl // Sig = ligne affichée, Ident inutilisé hors Go
+	idents map[string]bool
+	score  int
+}
+
+var identRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]{2,}`)
+
+// repoMapCache ne reconstruit la carte que si l'empreinte (chemins, tailles, dates) a changé,
+// et ne relit que les fichiers modifiés depuis la dernière carte.
+type repoMapCache struct {
+	mu          sync.Mutex
+	fingerprint string
+	text        string
+	files       map[string]*mapFile // nil : illisible, binaire ou trop gros
+}
+
+var repoMap = &repoMapCache{}
+
+func (c *repoMapCache) Get() string {
+	budget := Cfg.RepoMapTokens
+	if budget < 0 { return "" }
+	if budget == 0 { budget = RepoMapDefaultTokens }
+	type stat struct {
+		rel         string
+		size, mtime int64
+	}
+	var files []stat
+	h := sha1.New()
+	walkProject(".", func(rel string, d fs.DirEntry) error {
+		if d.IsDir() || len(files) >= RepoMapMaxFiles { return nil }
+		if info, err := d.Info(); err == nil {
+			st := stat{rel, info.Size(), info.ModTime().UnixNano()}
+			fmt.Fprintf(h, "%s %d %d\n", st.rel, st.size, st.mtime)
+			files = append(files, st)
+		}
+		return nil
+	})
+	fmt.Fprintf(h, "budget %d", budget)
+	fp := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fp == c.fingerprint { return c.text }
+	fset := token.NewFileSet()
+	cached := c.files
+	c.files = map[string]*mapFile{}
+	var mfs []*mapFile
+	for _, st := range files {
+		mf, ok := cached[st.rel]
+		if !ok || (mf != nil && (mf.size != st.size || mf.mtime != st.mtime)) {
+			mf = scanMapFile(fset, st.rel, st.size, st.mtime)
+		}
+		c.files[st.rel] = mf
+		if mf != nil { mfs = append(mfs, mf) }
+	}
+	c.fingerprint = fp
+	c.text = buildRepoMap(mfs, budget*4) // ~4 octets par token
+	return c.text
+}
+
+// scanMapFile lit les déclarations et les identifiants cités d'un fichier ; nil s'il est illisible,
+// binaire ou trop gros.
+func scanMapFile(fset *token.FileSet, rel string, size, mtime int64) *mapFile {
+	if size > 1<<20 { return nil }
+	data, err := os.ReadFile(rel)
+	if err != nil || len(data) > 1<<20 || textfile.IsBinary(data) { return nil }
+	mf := &mapFile{rel: rel, size: size, mtime: mtime, idents: map[string]bool{}}
+	ext := path.Ext(rel)
+	if ext == ".go" {
+		if f, _ := parser.ParseFile(fset, rel, data, 0); f != nil { mf.decls = goDecls(fset, f) }
+	} else if re := declPatterns[ext]; re != nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if m := re.FindStringSubmatch(line); m != nil {
+				sig := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(line), "{:"))
+				if len(sig) > 100 { sig = sig[:100] + "..." }
+				mf.decls = append(mf.decls, goDecl{Name: m[1], Sig: sig})
+			}
+		}
+	}
+	for _, id := range identRe.FindAllString(string(data), -1) { mf.idents[id] = true }
+	return mf
+}
+
+// buildRepoMap : arbre des dossiers puis déclarations par fichier. Un symbole vaut le nombre
+// d'autres fichiers qui citent son nom ; un fichier vaut la somme de ses symboles.
+func buildRepoMap(mfs []*mapFile, budget int) string {
+	seenIn := map[string]int{} // identifiant -> nb de fichiers
+	for _, mf := range mfs {
+		for id := range mf.idents { seenIn[id]++ }
+	}
+	mfs = slices.Clone(mfs) // l'ordre par score ne doit pas toucher la liste de l'appelant
+	symScore := func(d goDecl) int {
+		name := d.Name
+		if i := strings.LastIndex(name, "."); i >= 0 { name = name[i+1:] }
+		return seenIn[name] - 1 // hors fichier de définition
+	}
+	for _, mf := range mfs {
+		mf.score = 1
+		for _, d := range mf.decls { mf.score += symScore(d) }
+		if isManifest(mf.rel) { mf.score += 1000 }
+		sort.SliceStable(mf.decls, func(i, j int) bool { return symScore(mf.decls[i]) > symScore(mf.decls[j]) })
+	}
+	sort.SliceStable(mfs, func(i, j int) bool { return mfs[i].score > mfs[j].score })
+
+	// Arbre compact
+	var tree strings.Builder
+	dirCount := map[string]int{}
+	var dirs []string
+	for _, mf := range mfs {
+		d := path.Dir(mf.rel)
+		if dirCount[d] == 0 { dirs = append(dirs, d) }
+		dirCount[d]++
+	}
+	sort.Strings(dirs)
+	for i, d := range dirs {
+		if i == RepoMapMaxDirs { fmt.Fprintf(&tree, "... (%d more directories)\n", len(dirs)-RepoMapMaxDirs); break }
+		fmt.Fprintf(&tree, "%s/ (%d files)\n", d, dirCount[d])
+	}
+	used := tree.Len()
+
+	// Sélection par importance, puis affichage dans l'ordre des chemins
+	type entry struct {
+		rel  string
+		text string
+	}
+	var picked []entry
+	omitted := 0
+	for _, mf := range mfs {
+		var sb strings.Builder
+		sb.WriteString(mf.rel + "\n")
+		for i, d := range mf.decls {
+			if i == 12 { fmt.Fprintf(&sb, "  ... (%d more)\n", len(mf.decls)-12); break }
+			sb.WriteString("  " + d.Sig + "\n")
+		}
+		if used+sb.Len() > budget {
+			// pas la place pour les déclarations : au moins le nom du fichier
+			if used+len(mf.rel)+1 > budget { omitted++; continue }
+			sb.Reset()
+			sb.WriteString(mf.rel + "\n")
+		}
+		used += sb.Len()
+		picked = append(picked, entry{mf.rel, sb.String()})
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].rel < picked[j].rel })
+	var out strings.Builder
+	out.WriteString(tree.String() + "\n")
+	for _, e := range picked { out.WriteString(e.text) }
+	if omitted > 0 { fmt.Fprintf(&out, "... (%d more files)\n", omitted) }
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// --- RECHERCHE DE CODE (BM25, embeddings optionnels) ---
+
+const (
+	SearchIndexVersion = 1
+	SearchChunkLines   = 40 // taille max d'un morceau indexé
+	SearchMaxFiles     = 20000
+	SearchDefaultLimit = 8
+	SearchMaxLimit     = 30
+	SearchEmbedBatch   = 32
+	SearchEmbedBytes   = 2000 // texte envoyé par morceau au endpoint d'embeddings
+)
+
+var SearchIndexPath = filepath.Join(".nanocode", "index", "search.json")
+
+type searchChunk struct {
+	Line  int            `json:"l"` // lignes Line..End (à partir de 1)
+	End   int            `json:"e"`
+	Terms map[string]int `json:"t"`
+	Len   int            `json:"n"`
+	Vec   []float32      `json:"v,omitempty"` // normalisé : cosinus = produit scalaire
+}
+
+type searchFile struct {
+	Size   int64         `json:"size"`
+	Mtime  int64         `json:"mtime"`
+	Chunks []searchChunk `json:"chunks"`
+}
+
+type searchIndex struct {
+	Version int                    `json:"version"`
+	Model   string                 `json:"model,omitempty"` // "modèle@url" des vecteurs, vide sans embeddings
+	Files   map[string]*searchFile `json:"files"`
+}
+
+var (
+	searchMu  sync.Mutex
+	searchIdx *searchIndex
+	wordRe    = regexp.MustCompile(`[A-Za-z0-9_]+`)
+)
+
+// searchTokens découpe aussi les identifiants : parseHTTPRequest donne parsehttprequest, parse, http, request.
+func searchTokens(s string) []string {
+	var toks []string
+	for _, w := range wordRe.FindAllString(s, -1) {
+		if len(w) < 2 || strings.Trim(w, "0123456789") == "" { continue }
+		toks = append(toks, strings.ToLower(w))
+		if parts := splitIdent(w); len(parts) > 1 {
+			for _, p := range parts {
+				if len(p) >= 2 { toks = append(toks, p) }
+			}
+		}
+	}
+	return toks
+}
+
+func splitIdent(w string) []string {
+	upper := func(b byte) bool { return b >= 'A' && b <= 'Z' }
+	lower := func(b byte) bool { return b >= 'a' && b <= 'z' }
+	var parts []string
+	start := 0
+	for i := 1; i <= len(w); i++ {
+		cut := i == len(w) || w[i] == '_' ||
+			(upper(w[i]) && lower(w[i-1])) ||
+			(upper(w[i]) && upper(w[i-1]) && i+1 < len(w) && lower(w[i+1]))
+		if !cut { continue }
+		if start < i { parts = append(parts, strings.ToLower(w[start:i])) }
+		start = i
+		if i < len(w) && w[i] == '_' { start = i + 1 }
+	}
+	return parts
+}
+
+// chunkFile coupe en morceaux d'au plus SearchChunkLines lignes, de préférence sur une ligne vide
+// une fois la moitié atteinte, pour ne pas trancher les fonctions au hasard.
+func chunkFile(rel, text string) []searchChunk {
+	lines := strings.Split(text, "\n")
+	pathToks := searchTokens(rel)
+	var chunks []searchChunk
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && end-start < SearchChunkLines {
+			if end-start >= SearchChunkLines/2 && strings.TrimSpace(lines[end]) == "" { break }
+			end++
+		}
+		c := searchChunk{Line: start + 1, End: end, Terms: map[string]int{}}
+		for _, t := range searchTokens(strings.Join(lines[start:end], "\n")) { c.Terms[t]++; c.Len++ }
+		if c.Len > 0 {
+			for _, t := range pathToks { c.Terms[t]++; c.Len++ } // "auth" trouve aussi auth/handler.go
+			chunks = append(chunks, c)
+		}
+		start = end
+	}
+	return chunks
+}
+
+// updateSearchIndex remet l'index à jour d'après les tailles et dates des fichiers, puis l'enregistre.
+// L'erreur ne concerne que les embeddings : l'index BM25 reste utilisable.
+func updateSearchIndex(ctx context.Context) (*searchIndex, error) {
+	model := ""
+	if Cfg.Search.EmbeddingsURL != "" { model = Cfg.Search.EmbeddingsModel + "@" + Cfg.Search.EmbeddingsURL }
+	idx := searchIdx
+	if idx == nil {
+		idx = &searchIndex{}
+		if data, err := os.ReadFile(SearchIndexPath); err == nil { json.Unmarshal(data, idx) }
+	}
+	if idx.Version != SearchIndexVersion || idx.Model != model || idx.Files == nil {
+		idx = &searchIndex{Version: SearchIndexVersion, Model: model, Files: map[string]*searchFile{}}
+	}
+	searchIdx = idx
+
+	changed := false
+	seen := map[string]bool{}
+	walkProject(".", func(rel string, d fs.DirEntry) error {
+		if d.IsDir() || len(seen) >= SearchMaxFiles { return nil }
+		info, err := d.Info()
+		if err != nil { return nil }
+		seen[rel] = true
+		if f := idx.Files[rel]; f != nil && f.Size == info.Size() && f.Mtime == info.ModTime().UnixNano() { return nil }
+		f := &searchFile{Size: info.Size(), Mtime: info.ModTime().UnixNano()}
+		if data, err := os.ReadFile(rel); err == nil && len(data) <= 1<<20 && !textfile.IsBinary(data) {
+			f.Chunks = chunkFile(rel, string(data))
+		}
+		idx.Files[rel] = f
+		changed = true
+		return nil
+	})
+	for rel := range idx.Files {
+		if !seen[rel] { delete(idx.Files, rel); changed = true }
+	}
+	var err error
+	if model != "" {
+		var n int
+		n, err = embedMissing(ctx, idx)
+		if n > 0 { changed = true }
+	}
+	if changed { saveSearchIndex(idx) }
+	return idx, err
+}
+
+func saveSearchIndex(idx *searchIndex) {
+	dir := filepath.Dir(SearchIndexPath)
+	if os.MkdirAll(dir, 0755) != nil { return }
+	if _, err := os.Stat(filepath.Join(dir, ".gitignore")); err != nil {
+		os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*\n"), 0644)
+	}
+	data, _ := json.Marshal(idx)
+	if os.WriteFile(SearchIndexPath+".tmp", data, 0644) == nil { os.Rename(SearchIndexPath+".tmp", SearchIndexPath) }
+}
+
+// embedMissing calcule les vecteurs des morceaux qui n'en ont pas encore (nouveaux ou échec précédent).
+func embedMissing(ctx context.Context, idx *searchIndex) (int, error) {
+	var todo []*searchChunk
+	var texts []string
+	for rel, f := range idx.Files {
+		var lines []string
+		for i := range f.Chunks {
+			c := &f.Chunks[i]
+			if c.Vec != nil { continue }
+			if lines == nil {
+				data, err := os.ReadFile(rel)
+				if err != nil { break }
+				lines = strings.Split(string(data), "\n")
+			}
+			text := rel + "\n" + strings.Join(lines[min(c.Line-1, len(lines)):min(c.End, len(lines))], "\n")
+			if len(text) > SearchEmbedBytes { text = text[:SearchEmbedBytes] }
+			todo = append(todo, c)
+			texts = append(texts, text)
+		}
+	}
+	done := 0
+	for i := 0; i < len(todo); i += SearchEmbedBatch {
+		j := min(i+SearchEmbedBatch, len(todo))
+		vecs, err := embed(ctx, texts[i:j])
+		if err != nil { return done, err }
+		for k, v := range vecs { todo[i+k].Vec = v }
+		done += j - i
+	}
+	return done, nil
+}
+
+// embed interroge un endpoint compatible OpenAI (POST {model, input} -> data[].embedding).
+func embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, _ := json.Marshal(map[string]interface{}{"model": Cfg.Search.EmbeddingsModel, "input": texts})
+	req, _ := http.NewRequestWithContext(ctx, "POST", Cfg.Search.EmbeddingsURL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return nil, fmt.Errorf("embeddings API error %s", resp.Status) }
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil { return nil, err }
+	if len(out.Data) != len(texts) { return nil, fmt.Errorf("embeddings API returned %d vectors for %d inputs", len(out.Data), len(texts)) }
+	vecs := make([][]float32, len(texts))
+	for i, d := range out.Data {
+		if d.Index >= 0 && d.Index < len(texts) { i = d.Index }
+		var norm float64
+		for _, x := range d.Embedding { norm += float64(x) * float64(x) }
+		if norm == 0 { return nil, fmt.Errorf("embeddings API returned an empty vector") }
+		v := make([]float32, len(d.Embedding))
+		for k, x := range d.Embedding { v[k] = float32(float64(x) / math.Sqrt(norm)) }
+		vecs[i] = v
+	}
+	return vecs, nil
+}
+
+type searchArgs struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit,omitempty" desc:"number of results (default 8, max 30)"`
+}
+
+func toolSearchCode(ctx context.Context, a searchArgs) (string, error) {
+	query := a.Query
+	var terms []string
+	seenTerm := map[string]bool{}
+	for _, t := range searchTokens(query) {
+		if !seenTerm[t] { seenTerm[t] = true; terms = append(terms, t) }
+	}
+	if len(terms) == 0 { return "", errors.New("query missing") }
+	limit := SearchDefaultLimit
+	if a.Limit > 0 { limit = min(a.Limit, SearchMaxLimit) }
+
+	searchMu.Lock()
+	defer searchMu.Unlock()
+	idx, embedErr := updateSearchIndex(ctx)
+	var qvec []float32
+	if idx.Model != "" && embedErr == nil {
+		if v, err := embed(ctx, []string{query}); err == nil { qvec = v[0] } else { embedErr = err }
+	}
+
+	// BM25 (k1=1.2, b=0.75) par morceau
+	type hit struct {
+		rel       string
+		c         *searchChunk
+		bm25, cos float64
+		rank      float64
+	}
+	var hits []*hit
+	chunks, total := 0, 0
+	df := map[string]int{}
+	for _, f := range idx.Files {
+		for _, c := range f.Chunks {
+			chunks++
+			total += c.Len
+			for _, t := range terms {
+				if c.Terms[t] > 0 { df[t]++ }
+			}
+		}
+	}
+	if chunks == 0 { return "No matches (nothing indexed)", nil }
+	avg := float64(total) / float64(chunks)
+	for rel, f := range idx.Files {
+		for i := range f.Chunks {
+			h := &hit{rel: rel, c: &f.Chunks[i]}
+			for _, t := range terms {
+				tf := float64(h.c.Terms[t])
+				if tf == 0 { continue }
+				idf := math.Log(1 + (float64(chunks-df[t])+0.5)/(float64(df[t])+0.5))
+				h.bm25 += idf * tf * 2.2 / (tf + 1.2*(0.25+0.75*float64(h.c.Len)/avg))
+			}
+			if qvec != nil && len(h.c.Vec) == len(qvec) {
+				for k := range qvec { h.cos += float64(qvec[k]) * float64(h.c.Vec[k]) }
+			}
+			if h.bm25 > 0 || h.cos > 0 { hits = append(hits, h) }
+		}
+	}
+	if len(hits) == 0 { return "No matches", nil }
+
+	// Fusion par rangs (RRF) : robuste même si les deux scores n'ont pas la même échelle
+	fuse := func(key func(*hit) float64) {
+		sort.Slice(hits, func(i, j int) bool { return key(hits[i]) > key(hits[j]) })
+		for r, h := range hits {
+			if key(h) > 0 { h.rank += 1 / float64(60+r) }
+		}
+	}
+	fuse(func(h *hit) float64 { return h.bm25 })
+	if qvec != nil { fuse(func(h *hit) float64 { return h.cos }) }
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].rank != hits[j].rank { return hits[i].rank > hits[j].rank }
+		if hits[i].rel != hits[j].rel { return hits[i].rel < hits[j].rel }
+		return hits[i].c.Line < hits[j].c.Line
+	})
+
+	var sb strings.Builder
+	if embedErr != nil { fmt.Fprintf(&sb, "(embeddings unavailable, keyword ranking only: %v)\n", embedErr) }
+	for _, h := range hits[:min(limit, len(hits))] {
+		fmt.Fprintf(&sb, "\n%s:%d-%d\n%s", h.rel, h.c.Line, h.c.End, searchSnippet(h.rel, h.c, seenTerm))
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// searchSnippet montre une dizaine de lignes du morceau autour de la ligne qui contient le plus de termes.
+func searchSnippet(rel string, c *searchChunk, terms map[string]bool) string {
+	data, err := os.ReadFile(rel)
+	if err != nil { return "" }
+	lines := strings.Split(string(data), "\n")
+	first, last := min(c.Line-1, len(lines)), min(c.End, len(lines))
+	best, bestN := first, 0
+	for i := first; i < last; i++ {
+		n := 0
+		for _, t := range searchTokens(lines[i]) {
+			if terms[t] { n++ }
+		}
+		if n > bestN { best, bestN = i, n }
+	}
+	from := max(first, best-3)
+	var sb strings.Builder
+	for i := from; i < min(from+10, last); i++ {
+		line := lines[i]
+		if len(line) > 200 { line = line[:200] + "..." }
+		fmt.Fprintf(&sb, "%6d  %s\n", i+1, line)
+	}
+	return sb.String()
+}
+
+// --- PARCOURS DU PROJET (.gitignore) ---
+
+type ignoreRule struct {
+	base    string // dossier (relatif) du .gitignore
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher applique les .gitignore rencontrés pendant le parcours (sous-ensemble courant
+// de la syntaxe : !, / final, / initial, *, ?, **, [...]).
+type ignoreMatcher struct{ rules []ignoreRule }
+
+func (m *ignoreMatcher) load(dir, base string) {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil { return }
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+		r := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") { r.negate = true; line = line[1:] }
+		if strings.HasSuffix(line, "/") { r.dirOnly = true; line = strings.TrimRight(line, "/") }
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := globToRegexp(line)
+		if !anchored { expr = "(.*/)?" + expr }
+		if re, err := regexp.Compile("^" + expr + "$"); err == nil {
+			r.re = re
+			m.rules = append(m.rules, r)
+		}
+	}
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(.*/)?"); i += 2
+		case strings.HasPrefix(glob[i:], "/**"):
+			sb.WriteString("(/.*)?"); i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*"); i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 0 {
+				class := glob[i+1 : i+j]
+				if strings.HasPrefix(class, "!") { class = "^" + class[1:] }
+				sb.WriteString("[" + class + "]"); i += j
+			} else {
+				sb.WriteString(`\[`)
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+func (m *ignoreMatcher) Ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir { continue }
+		sub := rel
+		if r.base != "" {
+			if !strings.HasPrefix(rel, r.base+"/") { continue }
+			sub = rel[len(r.base)+1:]
+		}
+		if r.re.MatchString(sub) { ignored = !r.negate }
+	}
+	return ignored
+}
+
+// walkProject parcourt root en respectant les .gitignore ; .git et les fichiers cachés sont sautés.
+// fn reçoit des chemins relatifs à root, avec des / .
+func walkProject(root string, fn func(rel string, d fs.DirEntry) error) error {
+	m := &ignoreMatcher{}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil { return nil }
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			m.load(path, "")
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || m.Ignored(rel, d.IsDir()) {
+			if d.IsDir() { return filepath.SkipDir }
+			return nil
+		}
+		if d.IsDir() { m.load(path, rel) }
+		return fn(rel, d)
+	})
+}
+
+// --- ANALYSE DU PROJET (/i) ---
+
+const (
+	AnalysisPassBytes = 60000 // ~15k tokens par requête
+	AnalysisMaxPasses = 5
+	AnalysisFileBytes = 3000
+)
+
+var manifestNames = map[string]bool{
+	"go.mod": true, "Makefile": true, "package.json": true, "Cargo.toml": true, "pyproject.toml": true,
+	"requirements.txt": true, "setup.py": true, "pom.xml": true, "build.gradle": true, "Gemfile": true,
+	"composer.json": true, "CMakeLists.txt": true, "Dockerfile": true, "docker-compose.yml": true,
+	"justfile": true, "Taskfile.yml": true, "tsconfig.json": true, "CONTRIBUTING.md": true,
+}
+
+func isManifest(rel string) bool {
+	base := path.Base(rel)
+	return manifestNames[base] || strings.HasPrefix(strings.ToUpper(base), "README")
+}
+
+type analysisFile struct {
+	rel  string
+	body string
+}
+
+// isCompiled : exécutable binaire (sortie de build), à ne pas compter dans l'arbre. Les scripts
+// exécutables restent ; sous Windows, sans bit x, les binaires sont écartés à la lecture.
+func isCompiled(name string, d fs.DirEntry) bool {
+	info, err := d.Info()
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 { return false }
+	head, _, err := textfile.ReadHead(name, 8000)
+	return err == nil && textfile.IsBinary(head)
+}
+
+// collectAnalysisFiles renvoie les fichiers texte à montrer au modèle, dans l'ordre de priorité :
+// manifestes (les moins profonds d'abord), puis un fichier par dossier à tour de rôle pour
+// couvrir tout l'arbre. tree résume les dossiers et leur nombre de fichiers.
+func collectAnalysisFiles(root string) (files []analysisFile, tree string) {
+	var manifests []string
+	byDir := map[string][]string{}
+	var dirs []string
+	walkProject(root, func(rel string, d fs.DirEntry) error {
+		if d.IsDir() || rel == "agents.md" || isCompiled(filepath.Join(root, filepath.FromSlash(rel)), d) { return nil }
+		dir := path.Dir(rel)
+		if _, ok := byDir[dir]; !ok { dirs = append(dirs, dir) }
+		byDir[dir] = append(byDir[dir], rel)
+		if isManifest(rel) { manifests = append(manifests, rel) }
+		return nil
+	})
+	sort.SliceStable(manifests, func(i, j int) bool { return strings.Count(manifests[i], "/") < strings.Count(manifests[j], "/") })
+
+	var tb strings.Builder
+	for i, dir := range dirs {
+		if i == 80 { fmt.Fprintf(&tb, "... (%d more directories)\n", len(dirs)-80); break }
+		fmt.Fprintf(&tb, "%s/ (%d files)\n", dir, len(byDir[dir]))
+	}
+
+	// Seul le début de chaque fichier est lu, et on s'arrête une fois le budget de toutes les passes atteint
+	budget, left := AnalysisPassBytes*AnalysisMaxPasses, 0
+	read := func(rel string, limit int) {
+		if budget <= 0 { left++; return }
+		data, cut, err := textfile.ReadHead(filepath.Join(root, filepath.FromSlash(rel)), limit)
+		if err != nil || len(data) == 0 || textfile.IsBinary(data) { return }
+		if cut { data = append(data[:len(data):len(data)], "\n...[TRUNCATED]..."...) }
+		files = append(files, analysisFile{rel, string(data)})
+		budget -= len(rel) + len(data) + 20
+	}
+	taken := map[string]bool{}
+	for _, rel := range manifests { read(rel, 2*AnalysisFileBytes); taken[rel] = true }
+	for more := true; more && budget > 0; {
+		more = false
+		for _, dir := range dirs {
+			for len(byDir[dir]) > 0 {
+				rel := byDir[dir][0]
+				byDir[dir] = byDir[dir][1:]
+				if taken[rel] { continue }
+				read(rel, AnalysisFileBytes)
+				more = true
+				break
+			}
+		}
+	}
+	for _, dir := range dirs { left += len(byDir[dir]) }
+	if left > 0 { fmt.Fprintf(&tb, "(%d more files not read)\n", left) }
+	return files, tb.String()
+}
+
+func analyzeProject(ctx context.Context) string {
+	files, tree := collectAnalysisFiles(".")
+	if len(files) == 0 { fmt.Printf("%sNo files to analyze.%s\n", Yellow, Reset); return "" }
+
+	// Découpage en passes dans le budget ; au-delà du nombre max de passes, on s'arrête
+	var batches [][]analysisFile
+	size, skipped := AnalysisPassBytes, 0
+	for _, f := range files {
+		n := len(f.rel) + len(f.body) + 20
+		if size+n > AnalysisPassBytes {
+			if len(batches) == AnalysisMaxPasses { skipped++; continue }
+			batches = append(batches, nil)
+			size = 0
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], f)
+		size += n
+	}
+	fmt.Printf("%s(Analyzing %d files in %d pass(es) to update agents.md...)%s\n", Yellow, len(files)-skipped, len(batches), Reset)
+
+	const task = "Output a clean Markdown list of Coding Guidelines, patterns, build/test commands and Architecture notes (max 300 words). Do NOT act as an agent, just output the MD content"
+	render := func(batch []analysisFile) string {
+		var sb strings.Builder
+		for _, f := range batch { fmt.Fprintf(&sb, "\n--- FILE: %s ---\n%s\n", f.rel, f.body) }
+		return sb.String()
+	}
+	header := "Directory layout:\n" + tree
+	if skipped > 0 { header += fmt.Sprintf("(%d more files not shown)\n", skipped) }
+
+	// Stream sans outils pour voir l'analyse en direct : le modèle ne peut répondre que par du texte.
+	// Une réponse vide (ou une erreur) arrête tout, pour ne jamais proposer de vider la section.
+	ask := func(prompt string) string {
+		resp, _, err := streamChat(ctx, []Message{{Role: "user", Content: prompt}}, nil, os.Stdout)
+		if err != nil { fmt.Printf("%sAnalysis failed: %v%s\n", Red, err, Reset); return "" }
+		resp = strings.TrimSpace(resp)
+		if resp == "" { fmt.Printf("%sThe model returned no analysis; agents.md left unchanged.%s\n", Yellow, Reset) }
+		return resp
+	}
+	if len(batches) == 1 { return ask("Analyze these project files. " + task + ":\n" + header + render(batches[0])) }
+	var notes []string
+	for i, batch := range batches {
+		fmt.Printf("%s(Pass %d/%d)%s\n", Dim, i+1, len(batches), Reset)
+		resp := ask(fmt.Sprintf("Part %d/%d of a larger project. Take concise notes (max 200 words) on coding conventions, patterns, build/test commands and architecture visible in these files. Output only the notes:\n", i+1, len(batches)) + render(batch))
+		if resp == "" { return "" }
+		notes = append(notes, fmt.Sprintf("--- NOTES PART %d ---\n%s", i+1, resp))
+	}
+	return ask("Merge these partial analyses of one project into a single document. " + task + ":\n" + header + "\n" + strings.Join(notes, "\n\n"))
+}
+
+// --- ÉDITEUR DE LIGNE ---
+
+const HistoryMax = 1000
+
+// userConfigDir : ~/.config/nanocode, partagé par tous les projets.
+func userConfigDir() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "nanocode")
+}
+
+// lineEditor : édition au clavier (flèches, historique, Tab), entrée multi-ligne
+// (antislash final ou collage) et historique persistant par projet.
+// Le terminal passe en mode brut via stty uniquement pendant la saisie ; sans TTY on lit ligne par ligne.
+type lineEditor struct {
+	in       *bufio.Reader
+	tty      bool
+	history  []string
+	histPath string
+	width    int
+	row      int // ligne (relative au prompt) où se trouve le curseur
+}
+
+var editor *lineEditor
+
+func newLineEditor(cwd string) *lineEditor {
+	sum := sha1.Sum([]byte(cwd))
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), histPath: filepath.Join(userConfigDir(), "history", hex.EncodeToString(sum[:8]))}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && runtime.GOOS != "windows" {
+		_, err := stty("-g")
+		e.tty = err == nil
+	}
+	if data, err := os.ReadFile(e.histPath); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			var entry string
+			if json.Unmarshal([]byte(line), &entry) == nil && entry != "" { e.history = append(e.history, entry) }
+		}
+		if len(e.history) > HistoryMax {
+			e.history = e.history[len(e.history)-HistoryMax:]
+			e.rewriteHistory()
+		}
+	}
+	return e
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (e *lineEditor) rewriteHistory() {
+	var sb strings.Builder
+	for _, h := range e.history {
+		b, _ := json.Marshal(h)
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+	os.MkdirAll(filepath.Dir(e.histPath), 0755)
+	os.WriteFile(e.histPath, []byte(sb.String()), 0644)
+}
+
+func (e *lineEditor) addHistory(entry string) {
+	if strings.TrimSpace(entry) == "" { return }
+	if n := len(e.history); n > 0 && e.history[n-1] == entry { return }
+	e.history = append(e.history, entry)
+	os.MkdirAll(filepath.Dir(e.histPath), 0755)
+	f, err := os.OpenFile(e.histPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return }
+	b, _ := json.Marshal(entry)
+	f.Write(append(b, '\n'))
+	f.Close()
+}
+
+// ReadLine affiche le prompt et renvoie la saisie ; io.EOF sur Ctrl-D ou double Ctrl-C.
+func (e *lineEditor) ReadLine() (string, error) {
+	if !e.tty { return e.readPlain() }
+	saved, err := stty("-g")
+	if err != nil { return e.readPlain() }
+	stty("-icanon", "-echo", "-isig", "-ixon", "-iexten", "min", "1", "time", "0")
+	fmt.Print("\x1b[?2004h") // bracketed paste : un collage multi-ligne arrive en un bloc
+	defer func() {
+		fmt.Print("\x1b[?2004l")
+		stty(saved)
+	}()
+	e.width = 80
+	if out, err := stty("size"); err == nil {
+		var rows, cols int
+		if n, _ := fmt.Sscanf(out, "%d %d", &rows, &cols); n == 2 && cols > 0 { e.width = cols }
+	}
+	return e.edit()
+}
+
+func (e *lineEditor) readPlain() (string, error) {
+	var lines []string
+	prompt := Bold + Blue + "❯" + Reset + " "
+	for {
+		fmt.Print(prompt)
+		line, err := e.in.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if err != nil && line == "" && len(lines) == 0 { return "", io.EOF }
+		if strings.HasSuffix(line, "\\") && err == nil {
+			lines = append(lines, strings.TrimSuffix(line, "\\"))
+			prompt = Dim + "…" + Reset + " "
+			continue
+		}
+		lines = append(lines, line)
+		input := strings.Join(lines, "\n")
+		e.addHistory(input)
+		return input, nil
+	}
+}
+
+func (e *lineEditor) edit() (string, error) {
+	var buf []rune
+	pos := 0
+	histIdx := len(e.history)
+	draft := ""
+	e.row = 0
+	e.render(buf, pos)
+
+	set := func(v string) { buf = []rune(v); pos = len(buf) }
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil { fmt.Println(); return "", io.EOF }
+		switch r {
+		case '\r', '\n':
+			// antislash final : on continue sur une nouvelle ligne
+			if pos == len(buf) && pos > 0 && buf[pos-1] == '\\' {
+				buf[pos-1] = '\n'
+				break
+			}
+			pos = len(buf)
+			e.render(buf, pos)
+			fmt.Print("\n")
+			input := strings.TrimRight(string(buf), " \t") // la complétion laisse un espace final
+			e.addHistory(input)
+			return input, nil
+		case 3: // Ctrl-C
+			if len(buf) > 0 {
+				pos = len(buf)
+				e.render(buf, pos)
+				fmt.Print("^C\n")
+				buf, pos, e.row = nil, 0, 0
+				break
+			}
+			if double, _ := intr.Press(); double { fmt.Println(); return "", io.EOF }
+			fmt.Printf("\n%s(Ctrl-C again to quit)%s\n", Dim, Reset)
+			e.row = 0
+		case 4: // Ctrl-D
+			if len(buf) == 0 { fmt.Println(); return "", io.EOF }
+			if pos < len(buf) { buf = append(buf[:pos], buf[pos+1:]...) }
+		case 1: // Ctrl-A
+			pos = lineStart(buf, pos)
+		case 5: // Ctrl-E
+			pos = lineEnd(buf, pos)
+		case 11: // Ctrl-K
+			buf = append(buf[:pos], buf[lineEnd(buf, pos):]...)
+		case 21: // Ctrl-U
+			start := lineStart(buf, pos)
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' { start-- }
+			for start > 0 && buf[start-1] != ' ' && buf[start-1] != '\n' { start-- }
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case '\t':
+			var listing []string
+			buf, pos, listing = complete(buf, pos)
+			if len(listing) > 0 {
+				e.render(buf, len(buf))
+				fmt.Printf("\n%s%s%s\n", Dim, strings.Join(listing, "  "), Reset)
+				e.row = 0
+			}
+		case 27: // séquences d'échappement
+			switch seq := e.readEscape(); seq {
+			case "[A": // haut
+				if histIdx > 0 {
+					if histIdx == len(e.history) { draft = string(buf) }
+					histIdx--
+					set(e.history[histIdx])
+				}
+			case "[B": // bas
+				if histIdx < len(e.history) {
+					histIdx++
+					if histIdx == len(e.history) { set(draft) } else { set(e.history[histIdx]) }
+				}
+			case "[C", "OC":
+				if pos < len(buf) { pos++ }
+			case "[D", "OD":
+				if pos > 0 { pos-- }
+			case "[H", "OH", "[1~":
+				pos = lineStart(buf, pos)
+			case "[F", "OF", "[4~":
+				pos = lineEnd(buf, pos)
+			case "[3~":
+				if pos < len(buf) { buf = append(buf[:pos], buf[pos+1:]...) }
+			case "[200~":
+				paste := []rune(strings.ReplaceAll(e.readPaste(), "\r\n", "\n"))
+				for i, c := range paste {
+					if c == '\r' { paste[i] = '\n' }
+				}
+				buf = append(buf[:pos], append(paste, buf[pos:]...)...)
+				pos += len(paste)
+			}
+		default:
+			if r >= 32 {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		e.render(buf, pos)
+	}
+}
+
+func (e *lineEditor) readEscape() string {
+	// Échap seul : les touches envoient leur séquence d'un bloc, donc si rien n'attend dans le tampon
+	// on laisse au plus 100 ms à la suite au lieu de bloquer jusqu'à la touche suivante.
+	if e.in.Buffered() == 0 {
+		stty("min", "0", "time", "1")
+		_, err := e.in.Peek(1)
+		stty("min", "1", "time", "0")
+		if err != nil { return "" }
+	}
+	c, err := e.in.ReadByte()
+	if err != nil { return "" }
+	seq := []byte{c}
+	if c != '[' && c != 'O' { return string(seq) }
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil { break }
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e { break }
+	}
+	return string(seq)
+}
+
+func (e *lineEditor) readPaste() string {
+	var sb strings.Builder
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil { break }
+		if r == 27 {
+			if seq := e.readEscape(); seq == "[201~" { break }
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func lineStart(buf []rune, pos int) int {
+	for pos > 0 && buf[pos-1] != '\n' { pos-- }
+	return pos
+}
+
+func lineEnd(buf []rune, pos int) int {
+	for pos < len(buf) && buf[pos] != '\n' { pos++ }
+	return pos
+}
+
+// render redessine tout le bloc saisi (qui peut déborder sur plusieurs lignes) et replace le curseur.
+func (e *lineEditor) render(buf []rune, pos int) {
+	const promptWidth = 2
+	var sb strings.Builder
+	if e.row > 0 { fmt.Fprintf(&sb, "\x1b[%dA", e.row) }
+	sb.WriteString("\r\x1b[J" + Bold + Blue + "❯" + Reset + " ")
+	row, col := 0, promptWidth
+	curRow, curCol := 0, col
+	for i, r := range buf {
+		if i == pos { curRow, curCol = row, col }
+		if r == '\n' {
+			sb.WriteString("\n" + Dim + "…" + Reset + " ")
+			row, col = row+1, promptWidth
+			continue
+		}
+		w := runeWidth(r)
+		if col+w > e.width { row, col = row+1, 0 } // un caractère large qui ne tient plus passe à la ligne
+		sb.WriteRune(r)
+		col += w
+	}
+	if col == e.width {
+		sb.WriteString(" \r") // sort de l'état "retour à la ligne en attente" du terminal
+		row, col = row+1, 0
+	}
+	if pos == len(buf) { curRow, curCol = row, col }
+	if curCol == e.width { curRow, curCol = curRow+1, 0 }
+	if row > curRow { fmt.Fprintf(&sb, "\x1b[%dA", row-curRow) }
+	sb.WriteString("\r")
+	if curCol > 0 { fmt.Fprintf(&sb, "\x1b[%dC", curCol) }
+	e.row = curRow
+	fmt.Print(sb.String())
+}
+
+// runeWidth : colonnes occupées dans le terminal (0 pour un accent combinant, 2 pour le CJK et les emoji).
+func runeWidth(r rune) int {
+	switch {
+	case r == 0x200d || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0xa4cf && r != 0x303f, r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f, r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f, r >= 0x1f680 && r <= 0x1f6ff, r >= 0x1f900 && r <= 0x1faff, r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+// complete complète le mot sous le curseur : commande slash en début de saisie, sinon chemin de fichier
+// (éventuellement précédé de @ pour une mention).
+// Renvoie les candidats à afficher quand il y en a plusieurs.
+func complete(buf []rune, pos int) ([]rune, int, []string) {
+	start := pos
+	for start > 0 && buf[start-1] != ' ' && buf[start-1] != '\n' { start-- }
+	word := string(buf[start:pos])
+
+	var candidates []string
+	if start == 0 && strings.HasPrefix(word, "/") {
+		for _, c := range commandNames() {
+			if strings.HasPrefix(c, word) { candidates = append(candidates, c+" ") }
+		}
+	} else {
+		at := ""
+		if strings.HasPrefix(word, "@") { at = "@" }
+		dir, base := filepath.Split(strings.TrimPrefix(word, "@"))
+		readDir := dir
+		if readDir == "" { readDir = "." }
+		entries, _ := os.ReadDir(readDir)
+		for _, en := range entries {
+			name := en.Name()
+			if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) { continue }
+			if en.IsDir() { name += "/" }
+			candidates = append(candidates, at+dir+name)
+		}
+	}
+	if len(candidates) == 0 { return buf, pos, nil }
+
+	// Préfixe commun compté en runes : en octets, on couperait un caractère accentué en deux
+	prefix := []rune(candidates[0])
+	for _, c := range candidates[1:] {
+		n := 0
+		for _, r := range c {
+			if n == len(prefix) || prefix[n] != r { break }
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(candidates) == 1 && !strings.HasSuffix(candidates[0], "/") && !strings.HasSuffix(candidates[0], " ") { prefix = append(prefix, ' ') }
+	var listing []string
+	if len(candidates) > 1 && len(prefix) <= len([]rune(word)) {
+		for _, c := range candidates {
+			name := filepath.Base(strings.TrimSpace(c))
+			if strings.HasSuffix(c, "/") { name += "/" }
+			listing = append(listing, name)
+		}
+	}
+	out := append(append(append([]rune{}, buf[:start]...), prefix...), buf[pos:]...)
+	return out, start + len(prefix), listing
+}
+
+// --- MENTIONS @fichier ---
+
+// attachedNote signale à l'écran une mention jointe au message (voir internal/mention).
+func attachedNote(ref string) { fmt.Printf("%s(attached %s)%s\n", Dim, ref, Reset) }
+
+// --- COMMANDES SLASH ---
+
+// SlashCommand : commande intégrée (Run) ou personnalisée (Template, lue dans .nanocode/commands/*.md).
+type SlashCommand struct {
+	Name        string
+	Aliases     []string
+	Description string
+	Run         func(sess *Session, args string) (prompt string, quit bool)
+	Template    string
+	Source      string
+}
+
+// Session : l'état de la conversation courante.
+type Session struct {
+	Cwd     string
+	History []Message
+	// Sous-agent (outil task) : Label non vide, outils restreints et nombre d'appels au modèle borné
+	Label    string
+	Tools    []string // nil : tous les outils
+	MaxSteps int      // 0 : sans limite
+
+	memMu       sync.Mutex
+	memory      map[string]bool // agents.md déjà donnés au modèle dans cette conversation
+	hookContext string          // contexte fourni par les hooks session_start
+}
+
+// Reset relit les agents.md et repart d'un historique vide.
+func (s *Session) Reset() {
+	s.History = []Message{{Role: "system", Content: s.systemPrompt()}}
+}
+
+// Start lance les hooks session_start (source : "startup", "clear" ou "mcp") puis ouvre une conversation vierge.
+func (s *Session) Start(source string) {
+	s.hookContext = runHooks(context.Background(), "session_start", map[string]interface{}{"source": source}).Context
+	s.Reset()
+}
+
+// End lance les hooks session_end (reason : "exit", "interrupt" ou "clear").
+func (s *Session) End(reason string) {
+	runHooks(context.Background(), "session_end", map[string]interface{}{"reason": reason})
+}
+
+// RefreshRepoMap remet à jour la carte du dépôt dans le prompt système si des fichiers ont changé.
+func (s *Session) RefreshRepoMap() {
+	if len(s.History) == 0 { return }
+	p := s.History[0].Content
+	if i := strings.Index(p, RepoMapHeader); i >= 0 { p = p[:i] }
+	if m := repoMap.Get(); m != "" { p += RepoMapHeader + m }
+	s.History[0].Content = p
+}
+
+// ReloadMemory relit les agents.md sans effacer la conversation.
+func (s *Session) ReloadMemory() {
+	if len(s.History) == 0 { s.Reset(); return }
+	s.History[0].Content = s.systemPrompt()
+}
+
+var commands []*SlashCommand
+
+func builtinCommands() []*SlashCommand {
+	return []*SlashCommand{
+		{Name: "/help", Description: "List commands", Run: cmdHelp},
+		{Name: "/i", Description: "Analyze the project and update agents.md memory", Run: cmdInit},
+		{Name: "/c", Description: "Clear chat, reload memory and custom commands", Run: cmdClear},
+		{Name: "/memory", Description: "View, add, prune or edit facts learned in agents.md", Run: cmdMemory},
+		{Name: "/mcp", Description: "List MCP servers and their tools", Run: cmdMCP},
+		{Name: "/jobs", Description: "List background jobs", Run: func(*Session, string) (string, bool) {
+			fmt.Printf("%s%s%s\n", Dim, listJobs(), Reset)
+			return "", false
+		}},
+		{Name: "/q", Aliases: []string{"exit"}, Description: "Quit", Run: func(*Session, string) (string, bool) { return "", true }},
+	}
+}
+
+// loadCustomCommands recharge le registre : commandes intégrées, puis ~/.config/nanocode/commands,
+// puis .nanocode/commands du projet (le projet gagne en cas de doublon).
+func loadCustomCommands() {
+	commands = builtinCommands()
+	for _, dir := range []string{filepath.Join(userConfigDir(), "commands"), filepath.Join(".nanocode", "commands")} {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.md"))
+		sort.Strings(files)
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil { continue }
+			c := parseCommandFile(f, string(data))
+			if old := commandByName(c.Name); old != nil {
+				if old.Run != nil { continue } // on ne remplace pas une commande intégrée
+				*old = *c
+				continue
+			}
+			commands = append(commands, c)
+		}
+	}
+}
+
+// parseCommandFile lit un gabarit Markdown ; la description vient du frontmatter
+// "description:" ou, à défaut, de la première ligne non vide.
+func parseCommandFile(path, text string) *SlashCommand {
+	c := &SlashCommand{Name: "/" + strings.TrimSuffix(filepath.Base(path), ".md"), Source: path}
+	if strings.HasPrefix(text, "---\n") {
+		if end := strings.Index(text[4:], "\n---"); end >= 0 {
+			for _, line := range strings.Split(text[4:4+end], "\n") {
+				if k, v, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(k) == "description" {
+					c.Description = strings.Trim(strings.TrimSpace(v), `"'`)
+				}
+			}
+			text = strings.TrimLeft(text[4+end+4:], "\n")
+		}
+	}
+	c.Template = strings.TrimSpace(text)
+	if c.Description == "" {
+		for _, line := range strings.Split(c.Template, "\n") {
+			if line = strings.TrimSpace(strings.TrimLeft(line, "# ")); line != "" { c.Description = line; break }
+		}
+	}
+	if len(c.Description) > 70 { c.Description = c.Description[:67] + "..." }
+	return c
+}
+
+func commandByName(name string) *SlashCommand {
+	for _, c := range commands {
+		if c.Name == name { return c }
+		for _, a := range c.Aliases {
+			if a == name { return c }
+		}
+	}
+	return nil
+}
+
+// lookupCommand trouve la commande tapée : "/nom args" pour toutes, mais un alias sans "/" (exit)
+// seulement s'il est seul sur la ligne, pour qu'un prompt comme "exit early when..." parte au modèle.
+func lookupCommand(input string) *SlashCommand {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, "/") { return commandByName(input) }
+	name, _ := splitCommand(input)
+	return commandByName(name)
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, c := range commands { names = append(names, c.Name) }
+	return names
+}
+
+func splitCommand(input string) (string, string) {
+	input = strings.TrimSpace(input)
+	name, args, _ := strings.Cut(input, " ")
+	return name, strings.TrimSpace(args)
+}
+
+// runCommand exécute une commande ; prompt non vide = texte à envoyer au modèle.
+func runCommand(sess *Session, input string) (string, bool) {
+	_, args := splitCommand(input)
+	c := lookupCommand(input)
+	if c.Run != nil { return c.Run(sess, args) }
+	prompt := strings.ReplaceAll(c.Template, "$ARGUMENTS", args)
+	if args != "" && !strings.Contains(c.Template, "$ARGUMENTS") { prompt += "\n\n" + args }
+	fmt.Printf("%s(%s → %s)%s\n", Dim, c.Name, c.Source, Reset)
+	return prompt, false
+}
+
+func cmdHelp(*Session, string) (string, bool) {
+	for _, c := range commands {
+		name := c.Name
+		for _, a := range c.Aliases { name += ", " + a }
+		desc := c.Description
+		if c.Run == nil { desc += Dim + " (custom)" + Reset }
+		fmt.Printf("  %s%-12s%s %s\n", Green, name, Reset, desc)
+	}
+	fmt.Printf("%sCustom commands: .nanocode/commands/<name>.md (or ~/.config/nanocode/commands), $ARGUMENTS is replaced by what follows the command.%s\n", Dim, Reset)
+	return "", false
+}
+
+func cmdClear(sess *Session, _ string) (string, bool) {
+	sess.End("clear")
+	sess.Start("clear") // Relecture fraiche du fichier
+	loadCustomCommands()
+	bashShell.Close() // nouvelle conversation, nouveau shell
+	fmt.Printf("%sCleaned & Memory Reloaded.%s\n", Green, Reset)
+	return "", false
+}
+
+// cmdInit : ANALYSE ET SAUVEGARDE. Réécrit la section gérée d'agents.md après validation du diff.
+func cmdInit(sess *Session, _ string) (string, bool) {
+	ctx, done := intr.Begin()
+	guidelines := analyzeProject(ctx)
+	done()
+	if guidelines == "" { return "", false }
+
+	old, err := os.ReadFile("agents.md")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("%sError reading agents.md: %v%s\n", Red, err, Reset)
+		return "", false
+	}
+	updated := updateManagedSection(string(old), guidelines)
+	if n := strings.Count("\n"+string(old), "\n"+legacyHeading); n > 0 {
+		fmt.Printf("%sNote: agents.md still has %d old \"%s...)\" block(s) from earlier versions; they are left as is, delete them by hand if they are obsolete.%s\n", Yellow, n, legacyHeading, Reset)
+	}
+	if analysisDateRe.ReplaceAllString(updated, "") == analysisDateRe.ReplaceAllString(string(old), "") {
+		fmt.Printf("%s[agents.md already up to date]%s\n", Dim, Reset)
+		return "", false
+	}
+	fmt.Printf("\n%sProposed agents.md update:%s\n%s\n", Bold, Reset, lineDiff(string(old), updated))
+	if !confirm("Write agents.md?") {
+		fmt.Printf("%s[agents.md left unchanged]%s\n", Dim, Reset)
+		return "", false
+	}
+	if err := os.WriteFile("agents.md", []byte(updated), 0644); err != nil {
+		fmt.Printf("%sError writing agents.md: %v%s\n", Red, err, Reset)
+		return "", false
+	}
+	fmt.Printf("%s[agents.md updated on disk]%s\n", Green, Reset)
+
+	// Rechargement immédiat du cerveau
+	sess.Reset()
+	fmt.Printf("%sContext reloaded from agents.md.%s\n", Green, Reset)
+	return "", false
+}
+
+const (
+	ManagedStart  = "<!-- nanocode:auto-analysis:start -->"
+	ManagedEnd    = "<!-- nanocode:auto-analysis:end -->"
+	legacyHeading = "### AUTO-ANALYSIS ("
+)
+
+// La date du titre ne compte pas pour décider si agents.md a changé.
+var analysisDateRe = regexp.MustCompile(`(?m)^## Auto-analysis \(\d{4}-\d{2}-\d{2}\)$`)
+
+// updateManagedSection remplace le bloc entre les marqueurs (ou l'ajoute à la fin). Tout le reste est
+// conservé, y compris les anciens blocs "### AUTO-ANALYSIS (...) ###" : rien ne marque leur fin, et
+// couper jusqu'au titre suivant emporterait les notes écrites à la main après eux.
+func updateManagedSection(text, guidelines string) string {
+	section := ManagedStart + "\n<!-- Managed by nanocode /i: edits inside this block are overwritten. -->\n" +
+		"## Auto-analysis (" + time.Now().Format("2006-01-02") + ")\n\n" +
+		strings.TrimSpace(guidelines) + "\n" + ManagedEnd
+	return replaceBlock(text, ManagedStart, ManagedEnd, section)
+}
+
+// replaceBlock remplace le bloc start...end de text par section (marqueurs compris), ou l'ajoute à la fin.
+func replaceBlock(text, start, end, section string) string {
+	if i := strings.Index(text, start); i >= 0 {
+		if j := strings.Index(text[i:], end); j >= 0 {
+			return text[:i] + section + text[i+j+len(end):]
+		}
+		return text[:i] + section + "\n" // marqueur de fin perdu : le bloc va jusqu'à la fin
+	}
+	text = strings.TrimSpace(text)
+	if text == "" { return section + "\n" }
+	return text + "\n\n" + section + "\n"
+}
+
+// lineDiff : diff ligne à ligne (LCS) avec 2 lignes de contexte, en couleur.
+func lineDiff(a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs { lcs[i] = make([]int, len(y)+1) }
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type op struct {
+		kind byte
+		line string
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, op{' ', x[i]}); i++; j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', x[i]}); i++
+		default:
+			ops = append(ops, op{'+', y[j]}); j++
+		}
+	}
+	const contextLines = 2
+	var sb strings.Builder
+	lastShown := -1
+	for k, o := range ops {
+		near := false
+		for d := -contextLines; d <= contextLines; d++ {
+			if k+d >= 0 && k+d < len(ops) && ops[k+d].kind != ' ' { near = true; break }
+		}
+		if !near { continue }
+		if lastShown >= 0 && k > lastShown+1 { sb.WriteString(Dim + "  ..." + Reset + "\n") }
+		lastShown = k
+		switch o.kind {
+		case '+': sb.WriteString(Green + "+ " + o.line + Reset + "\n")
+		case '-': sb.WriteString(Red + "- " + o.line + Reset + "\n")
+		default: sb.WriteString(Dim + "  " + o.line + Reset + "\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// confirm pose une question oui/non (non par défaut) sur le terminal.
+func confirm(question string) bool {
+	fmt.Printf("%s%s [y/N]%s ", Yellow, question, Reset)
+	in := bufio.NewReader(os.Stdin)
+	if editor != nil { in = editor.in } // même tampon que l'éditeur, sinon on perd des octets
+	line, _ := in.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes" || answer == "o" || answer == "oui"
+}
+
+// --- MÉMOIRE DURABLE (remember, /memory) ---
+
+const (
+	MemoryStart = "<!-- nanocode:memory:start -->"
+	MemoryEnd   = "<!-- nanocode:memory:end -->"
+)
+
+var memoryCategories = []struct{ Key, Title string }{
+	{"build", "Build & test commands"},
+	{"convention", "Conventions"},
+	{"gotcha", "Gotchas"},
+	{"other", "Other"},
+}
+
+type memoryFact struct {
+	Category string
+	Text     string
+}
+
+// readFacts extrait les faits (puces) de la section mémoire d'agents.md.
+func readFacts(text string) []memoryFact {
+	i := strings.Index(text, MemoryStart)
+	if i < 0 { return nil }
+	block := text[i:]
+	if j := strings.Index(block, MemoryEnd); j >= 0 { block = block[:j] }
+	var facts []memoryFact
+	cat := "other"
+	for _, line := range strings.Split(block, "\n") {
+		line = strings.TrimSpace(line)
+		if title, ok := strings.CutPrefix(line, "### "); ok {
+			cat = "other"
+			for _, c := range memoryCategories {
+				if c.Title == title { cat = c.Key }
+			}
+		} else if fact, ok := strings.CutPrefix(line, "- "); ok && strings.TrimSpace(fact) != "" {
+			facts = append(facts, memoryFact{cat, strings.TrimSpace(fact)})
+		}
+	}
+	return facts
+}
+
+// writeFacts réécrit la section mémoire, faits regroupés par catégorie.
+func writeFacts(text string, facts []memoryFact) string {
+	var sb strings.Builder
+	sb.WriteString(MemoryStart + "\n## Learned facts\n<!-- Maintained by nanocode (remember tool, /memory). -->\n")
+	for _, c := range memoryCategories {
+		first := true
+		for _, f := range facts {
+			if f.Category != c.Key { continue }
+			if first { sb.WriteString("\n### " + c.Title + "\n"); first = false }
+			sb.WriteString("- " + f.Text + "\n")
+		}
+	}
+	sb.WriteString(MemoryEnd)
+	return replaceBlock(text, MemoryStart, MemoryEnd, sb.String())
+}
+
+func normalizeFact(v string) string {
+	var sb strings.Builder
+	for _, w := range strings.FieldsFunc(strings.ToLower(v), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		sb.WriteString(w + " ")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// knownFact cherche un doublon dans tout agents.md (faits appris, analyse /i ou texte manuel).
+func knownFact(text, fact string) bool {
+	n := normalizeFact(fact)
+	if n == "" { return true }
+	for _, line := range strings.Split(text, "\n") {
+		l := normalizeFact(line)
+		if l == n || (len(n) > 20 && strings.Contains(l, n)) { return true }
+	}
+	return false
+}
+
+type rememberArgs struct {
+	Category string `json:"category" enum:"build,convention,gotcha,other"`
+	Fact     string `json:"fact"`
+}
+
+func toolRemember(_ context.Context, a rememberArgs) (string, error) {
+	fact := strings.Join(strings.Fields(a.Fact), " ") // une puce = une ligne
+	if fact == "" { return "", errors.New("fact missing") }
+	cat := a.Category
+	valid := false
+	for _, c := range memoryCategories {
+		if c.Key == cat { valid = true }
+	}
+	if !valid { cat = "other" }
+
+	data, err := os.ReadFile("agents.md")
+	if err != nil && !os.IsNotExist(err) { return "", err }
+	text := string(data)
+	if knownFact(text, fact) { return "Already in agents.md, nothing written.", nil }
+	facts := append(readFacts(text), memoryFact{cat, fact})
+	if err := os.WriteFile("agents.md", []byte(writeFacts(text, facts)), 0644); err != nil { return "", err }
+	fmt.Printf("%s[agents.md: remembered (%s) %s]%s\n", Green, cat, fact, Reset)
+	return "Remembered in agents.md under " + cat + ".", nil
+}
+
+func saveFacts(facts []memoryFact) error {
+	data, err := os.ReadFile("agents.md")
+	if err != nil && !os.IsNotExist(err) { return err }
+	return os.WriteFile("agents.md", []byte(writeFacts(string(data), facts)), 0644)
+}
+
+func printFacts(facts []memoryFact) {
+	if len(facts) == 0 { fmt.Printf("%sNo learned facts yet in agents.md.%s\n", Dim, Reset); return }
+	for _, c := range memoryCategories {
+		first := true
+		for i, f := range facts {
+			if f.Category != c.Key { continue }
+			if first { fmt.Printf("%s%s%s\n", Bold, c.Title, Reset); first = false }
+			fmt.Printf("  %s%3d%s %s\n", Dim, i+1, Reset, f.Text)
+		}
+	}
+}
+
+// cmdMemory : /memory, /memory add <category>: <fact>, /memory rm <n>..., /memory prune, /memory edit
+func cmdMemory(sess *Session, args string) (string, bool) {
+	data, _ := os.ReadFile("agents.md")
+	facts := readFacts(string(data))
+	sub, rest := splitCommand(args)
+	switch sub {
+	case "":
+		printFacts(facts)
+		fmt.Printf("%sUsage: /memory add <build|convention|gotcha|other>: <fact>, /memory rm <n>..., /memory prune, /memory edit%s\n", Dim, Reset)
+		return "", false
+	case "add":
+		cat, fact, ok := strings.Cut(rest, ":")
+		if !ok { cat, fact = "other", rest }
+		res, err := toolRemember(context.Background(), rememberArgs{Category: strings.TrimSpace(cat), Fact: fact})
+		if err != nil { res = "Error: " + err.Error() }
+		fmt.Println(res)
+	case "rm":
+		drop := map[int]bool{}
+		for _, f := range strings.Fields(rest) {
+			if n, err := strconv.Atoi(f); err == nil && n >= 1 && n <= len(facts) { drop[n-1] = true }
+		}
+		if len(drop) == 0 { fmt.Printf("%sNothing to remove (see /memory for numbers).%s\n", Red, Reset); return "", false }
+		var kept []memoryFact
+		for i, f := range facts {
+			if !drop[i] { kept = append(kept, f) }
+		}
+		if err := saveFacts(kept); err != nil { fmt.Printf("%sError: %v%s\n", Red, err, Reset); return "", false }
+		fmt.Printf("%s[agents.md: %d fact(s) removed]%s\n", Green, len(drop), Reset)
+	case "prune":
+		var kept []memoryFact
+		for _, f := range facts {
+			if confirm(fmt.Sprintf("Drop (%s) %s?", f.Category, f.Text)) { continue }
+			kept = append(kept, f)
+		}
+		if len(kept) == len(facts) { return "", false }
+		if err := saveFacts(kept); err != nil { fmt.Printf("%sError: %v%s\n", Red, err, Reset); return "", false }
+		fmt.Printf("%s[agents.md: %d fact(s) removed]%s\n", Green, len(facts)-len(kept), Reset)
+	case "edit":
+		ed := os.Getenv("EDITOR")
+		if ed == "" { ed = "vi" }
+		cmd := exec.Command("sh", "-c", ed+" agents.md")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil { fmt.Printf("%sError: %v%s\n", Red, err, Reset); return "", false }
+	default:
+		fmt.Printf("%sUnknown /memory subcommand %q%s\n", Red, sub, Reset)
+		return "", false
+	}
+	sess.ReloadMemory()
+	return "", false
+}
+
+// --- HOOKS (scripts utilisateur branchés sur les événements) ---
+
+const (
+	HookDefaultTimeout   = 30 * time.Second
+	HookMaxStopContinues = 3 // un hook stop ne peut pas relancer le modèle indéfiniment
+)
+
+// Événements : pre_tool_use, post_tool_use, user_prompt_submit, session_start, session_end, stop.
+type HookConfig struct {
+	Command string   `json:"command"`
+	Tools   []string `json:"tools"`   // pre/post_tool_use : seulement ces outils (tous si vide)
+	Timeout int      `json:"timeout"` // secondes
+}
+
+// HookDecision est lu sur la sortie standard du hook ; tout est optionnel.
+type HookDecision struct {
+	Decision string                 `json:"decision"` // "block" : refuse l'outil / le prompt, ou relance le modèle (stop)
+	Reason   string                 `json:"reason"`
+	Args     map[string]interface{} `json:"args"`    // pre_tool_use : nouveaux arguments
+	Result   *string                `json:"result"`  // post_tool_use : remplace le résultat
+	Prompt   *string                `json:"prompt"`  // user_prompt_submit : remplace le prompt
+	Context  string                 `json:"context"` // texte ajouté au prompt, au résultat, ou au prompt système (session_start)
+}
+
+// runHooks lance dans l'ordre les hooks de event ; les réécritures s'enchaînent, le premier "block" arrête.
+func runHooks(ctx context.Context, event string, payload map[string]interface{}) HookDecision {
+	var out HookDecision
+	tool, _ := payload["tool"].(string)
+	cwd, _ := os.Getwd()
+	for _, h := range Cfg.Hooks[event] {
+		if h.Command == "" || (len(h.Tools) > 0 && !slices.Contains(h.Tools, tool)) { continue }
+		payload["event"], payload["cwd"] = event, cwd
+		d, err := runHook(ctx, h, event, payload)
+		if err != nil {
+			fmt.Printf("%sWarning: %s hook failed: %v%s\n", Yellow, event, err, Reset)
+			continue
+		}
+		if d.Args != nil { out.Args, payload["args"] = d.Args, d.Args }
+		if d.Prompt != nil { out.Prompt, payload["prompt"] = d.Prompt, *d.Prompt }
+		if d.Result != nil { out.Result, payload["result"] = d.Result, *d.Result }
+		if d.Context != "" { out.Context = strings.TrimSpace(out.Context + "\n" + d.Context) }
+		if d.Decision == "block" {
+			out.Decision, out.Reason = "block", d.Reason
+			break
+		}
+	}
+	return out
+}
+
+// runHook : JSON sur stdin, décision JSON sur stdout. Code 2 = blocage (raison sur stderr),
+// autre code non nul = hook en erreur, ignoré.
+func runHook(parent context.Context, h HookConfig, event string, payload map[string]interface{}) (HookDecision, error) {
+	var d HookDecision
+	timeout := HookDefaultTimeout
+	if h.Timeout > 0 { timeout = time.Duration(h.Timeout) * time.Second }
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	data, _ := json.Marshal(payload)
+	cmd := exec.CommandContext(ctx, "bash", "-c", h.Command)
+	shell.Prepare(cmd)
+	cmd.Env = append(os.Environ(), "NANOCODE_EVENT="+event)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 2 {
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" { reason = strings.TrimSpace(stdout.String()) }
+		return HookDecision{Decision: "block", Reason: reason}, nil
+	}
+	if ctx.Err() == context.DeadlineExceeded { return d, fmt.Errorf("%s: timed out after %s", h.Command, timeout) }
+	if err != nil { return d, fmt.Errorf("%s", strings.TrimSpace(fmt.Sprintf("%s: %v %s", h.Command, err, stderr.String()))) }
+	if strings.TrimSpace(stdout.String()) == "" { return d, nil }
+	if err := json.Unmarshal(stdout.Bytes(), &d); err != nil { return d, fmt.Errorf("%s: invalid JSON output: %v", h.Command, err) }
+	return d, nil
+}
+
+// --- INTERRUPTIONS (Ctrl-C) ---
+
+const Interrupted = "[interrupted by user]"
+
+// interrupter : Ctrl-C annule le tour en cours (stream ou outil) ; deux Ctrl-C rapprochés quittent.
+type interrupter struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	last   time.Time
+}
+
+var intr = &interrupter{}
+
+// Begin ouvre un tour annulable ; la fonction renvoyée le ferme.
+func (in *interrupter) Begin() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in.mu.Lock()
+	in.cancel = cancel
+	in.mu.Unlock()
+	return ctx, func() {
+		in.mu.Lock()
+		in.cancel = nil
+		in.mu.Unlock()
+		cancel()
+	}
+}
+
+// Press enregistre un Ctrl-C : double=true si c'est le second en moins de 2s,
+// sinon annule le tour en cours s'il y en a un.
+func (in *interrupter) Press() (double, cancelled bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	double = time.Since(in.last) < 2*time.Second
+	in.last = time.Now()
+	if !double && in.cancel != nil {
+		in.cancel()
+		cancelled = true
+	}
+	return double, cancelled
+}
+
+// Listen traite Ctrl-C ; SIGTERM et SIGHUP (terminal fermé) quittent tout de suite, avec le même
+// ménage (jobs, shell, serveurs) que le double Ctrl-C.
+func (in *interrupter) Listen(onExit func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range ch {
+			if sig != os.Interrupt {
+				onExit()
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}
+			double, cancelled := in.Press()
+			if double {
+				fmt.Println()
+				onExit()
+				os.Exit(130)
+			}
+			if cancelled {
+				fmt.Printf("\n%s%s (Ctrl-C again to quit)%s\n", Yellow, Interrupted, Reset)
+				continue
+			}
+			fmt.Printf("\n%s(Ctrl-C again to quit)%s\n%s%s❯%s ", Dim, Reset, Bold, Blue, Reset)
+		}
+	}()
+}
+
+// --- ORCHESTRATEUR ---
+
+// execTool exécute un appel d'outil, encadré par les hooks pre/post_tool_use. Il renvoie le texte
+// donné au modèle, et une erreur si l'appel a échoué ou a été bloqué (isError pour un client MCP).
+// Un appel bloqué par pre_tool_use n'a pas tourné : les hooks post_tool_use ne le voient pas.
+func execTool(ctx context.Context, fname string, args map[string]interface{}) (string, error) {
+	pre := runHooks(ctx, "pre_tool_use", map[string]interface{}{"tool": fname, "args": args})
+	if pre.Args != nil { args = pre.Args }
+	if pre.Decision == "block" {
+		res := "Blocked by hook: " + pre.Reason
+		return res, errors.New(res)
+	}
+	var res string
+	var err error
+	if t := toolsFrom(ctx).Lookup(fname); t != nil {
+		res, err = t.Execute(ctx, args)
+	} else {
+		err = errors.New("unknown tool " + fname)
+	}
+	if err != nil { res = "Error: " + err.Error() }
+	post := runHooks(ctx, "post_tool_use", map[string]interface{}{"tool": fname, "args": args, "result": res})
+	if post.Result != nil { res = *post.Result }
+	if post.Decision == "block" { res += "\n\n[hook] " + post.Reason }
+	if post.Context != "" { res += "\n\n" + post.Context }
+	return res, err
+}
+
+// ParallelTools : outils sans effet de bord, lancés en parallèle quand le modèle en appelle plusieurs
+// d'affilée. Les autres (write, edit, bash, jobs, MCP, plugins...) passent un par un, dans l'ordre.
+var ParallelTools = []string{"read", "glob", "search_code", "go_symbols", "go_definition", "go_references", "lsp_diagnostics", "lsp_definition", "lsp_references", "job_status"}
+
+const ToolWorkers = 4 // appels simultanés au plus
+
+// parallelSafe : l'appel ne modifie rien (outil de ParallelTools, ou task limité à ces outils).
+func parallelSafe(c ToolCall) bool {
+	if c.Function.Name != "task" { return slices.Contains(ParallelTools, c.Function.Name) }
+	var a taskArgs
+	json.Unmarshal([]byte(c.Function.Arguments), &a)
+	for _, n := range a.Tools {
+		if !slices.Contains(ParallelTools, n) { return false }
+	}
+	return true
+}
+
+// runTools exécute les appels d'un tour et renvoie les réponses dans l'ordre des appels, que les
+// fournisseurs rapprochent des tool_call_id. Un appel qui modifie quelque chose attend les précédents
+// et bloque les suivants : une lecture après un write voit bien le fichier écrit.
+func (s *Session) runTools(ctx context.Context, calls []ToolCall) []Message {
+	out := make([]Message, len(calls))
+	pfx := ""
+	if s.Label != "" { pfx = Dim + "  ↳ " + s.Label + " " + Reset }
+	run := func(i int) {
+		fname := calls[i].Function.Name
+		out[i] = Message{Role: "tool", ToolCallID: calls[i].ID, Name: fname, Content: Interrupted}
+		// Chaque tool_call doit avoir sa réponse, même ceux qu'on n'exécute plus
+		if ctx.Err() != nil { return }
+		if s.Tools != nil && !slices.Contains(s.Tools, fname) {
+			out[i].Content = fmt.Sprintf("Error: tool %s is not available here (allowed: %s)", fname, strings.Join(s.Tools, ", "))
+			return
+		}
+		var args map[string]interface{}
+		json.Unmarshal([]byte(calls[i].Function.Arguments), &args)
+		res, _ := execTool(ctx, fname, args)
+		if ctx.Err() != nil { res += "\n" + Interrupted }
+		out[i].Content = res
+	}
+	preview := func(i int) {
+		p := strings.ReplaceAll(out[i].Content, "\n", " ")
+		if len(p) > 60 { p = p[:60] + "..." }
+		fmt.Printf("%s%s⎿ %s%s\n", pfx, Dim, p, Reset)
+	}
+	for i := 0; i < len(calls); {
+		j := i + 1
+		if parallelSafe(calls[i]) {
+			for j < len(calls) && parallelSafe(calls[j]) { j++ }
+		}
+		if j == i+1 {
+			if ctx.Err() == nil { fmt.Printf("%s%s[EXEC: %s]%s\n", pfx, Green, strings.ToUpper(calls[i].Function.Name), Reset) }
+			run(i)
+			if out[i].Content != Interrupted { preview(i) }
+			i = j
+			continue
+		}
+		// Lectures groupées : l'affichage attend la fin du lot pour ne pas mélanger les lignes
+		if ctx.Err() == nil { fmt.Printf("%s%s[EXEC: %d tools in parallel]%s\n", pfx, Green, j-i, Reset) }
+		sem := make(chan struct{}, ToolWorkers)
+		var wg sync.WaitGroup
+		for k := i; k < j; k++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				run(k)
+			}()
+		}
+		wg.Wait()
+		for k := i; k < j; k++ {
+			if out[k].Content == Interrupted { continue }
+			fmt.Printf("%s%s  %s%s\n", pfx, Green, strings.ToUpper(calls[k].Function.Name), Reset)
+			preview(k)
+		}
+		i = j
+	}
+	return out
+}
+
+// Turn fait tourner la boucle orchestrateur jusqu'à une réponse sans appel d'outil et renvoie ce texte.
+// Interrompu (ctx annulé), l'historique reste cohérent : chaque tool_call reçoit une réponse.
+func (s *Session) Turn(ctx context.Context) (string, error) {
+	ctx = context.WithValue(ctx, sessionKey{}, s) // les outils retrouvent leur session (agents.md déjà chargés)
+	parent, out := toolsFrom(ctx), io.Writer(os.Stdout) // un sous-agent reprend les outils figés de son parent
+	if s.Label != "" { out = io.Discard } // un sous-agent ne montre que ses appels d'outils
+	stops, steps := 0, 0
+	for {
+		// Outils figés pour ce tour : les sources MCP ne sont relistées qu'ici, une fois
+		reg := parent.Snapshot()
+		if s.Tools != nil { reg = reg.Only(s.Tools) }
+		tctx := context.WithValue(ctx, toolsKey{}, reg)
+		schemas := reg.OpenAISchemas()
+		steps++
+		final := s.MaxSteps > 0 && steps >= s.MaxSteps
+		if final {
+			// Dernier appel permis : plus d'outils, le modèle doit conclure
+			schemas = nil
+			if last := &s.History[len(s.History)-1]; last.Role == "tool" { // Mistral refuse un message user juste après un tool
+				last.Content += "\n\n" + StepBudgetNote
+			} else {
+				s.History = append(s.History, Message{Role: "user", Content: StepBudgetNote})
+			}
+		}
+		content, tools, err := streamChat(ctx, s.History, schemas, out)
+		if ctx.Err() != nil {
+			s.History = append(s.History, Message{Role: "assistant", Content: strings.TrimSpace(content + "\n" + Interrupted)})
+			return content, ctx.Err()
+		}
+		if err != nil { return "", err }
+		if final { tools = nil }
+
+		s.History = append(s.History, Message{Role: "assistant", Content: content, ToolCalls: tools})
+
+		if len(tools) > 0 {
+			s.History = append(s.History, s.runTools(tctx, tools)...)
+			if ctx.Err() != nil { return "", ctx.Err() }
+			fmt.Fprintf(out, "%s(🔄 Orchestrator analyzing result...)%s\n", Yellow, Reset)
+			continue
+		}
+		if s.Label != "" { return content, nil }
+		// Un hook stop peut refuser la fin du tour : sa raison repart au modèle
+		stop := runHooks(ctx, "stop", map[string]interface{}{"last_message": content, "stop_hook_active": stops > 0})
+		if stop.Decision == "block" && stop.Reason != "" && stops < HookMaxStopContinues && ctx.Err() == nil {
+			stops++
+			fmt.Printf("%s(🔄 Stop hook: %s)%s\n", Yellow, stop.Reason, Reset)
+			s.History = append(s.History, Message{Role: "user", Content: stop.Reason})
+			continue
+		}
+		return content, nil
+	}
+}
+
+// --- SOUS-AGENTS (outil task) ---
+
+const (
+	TaskDefaultSteps = 15
+	TaskMaxSteps     = 50
+	TaskSystemNote   = "\n\nYOU ARE A SUB-AGENT working on one delegated task. Nobody will answer questions: investigate with your tools, then reply with a concise final summary (findings, file:line references, what is left unresolved). That reply is all the calling agent will see."
+	StepBudgetNote   = "[Step budget exhausted: tools are no longer available. Reply now with your final summary of what you found.]"
+)
+
+type taskArgs struct {
+	Description string   `json:"description" desc:"3-5 word label shown to the user"`
+	Prompt      string   `json:"prompt" desc:"complete instructions; the sub-agent does not see this conversation"`
+	Tools       []string `json:"tools,omitempty" desc:"tools it may use (default: read-only tools)"`
+	MaxSteps    int      `json:"max_steps,omitempty" desc:"model calls allowed (default 15, max 50)"`
+}
+
+// toolTask fait tourner un orchestrateur enfant sur un historique neuf et ne renvoie que sa conclusion.
+func toolTask(ctx context.Context, a taskArgs) (string, error) {
+	if strings.TrimSpace(a.Prompt) == "" { return "", errors.New("prompt missing") }
+	names := a.Tools
+	if len(names) == 0 {
+		for _, n := range ParallelTools {
+			if toolsFrom(ctx).Lookup(n) != nil { names = append(names, n) }
+		}
+	}
+	for _, n := range names {
+		if n == "task" { return "", errors.New("a sub-agent cannot start other sub-agents") }
+		if toolsFrom(ctx).Lookup(n) == nil { return "", errors.New("unknown tool " + n) }
+	}
+	steps := TaskDefaultSteps
+	if a.MaxSteps > 0 { steps = min(a.MaxSteps, TaskMaxSteps) }
+	label := strings.TrimSpace(a.Description)
+	if label == "" { label = "task" }
+	cwd, _ := os.Getwd()
+	sub := &Session{Cwd: cwd, Label: "[" + label + "]", Tools: names, MaxSteps: steps}
+	if parent := sessionFrom(ctx); parent != nil { sub.hookContext = parent.hookContext }
+	sub.Reset()
+	sub.History[0].Content += TaskSystemNote
+	sub.History = append(sub.History, Message{Role: "user", Content: a.Prompt})
+	answer, err := sub.Turn(ctx)
+	if ctx.Err() != nil { return "", errors.New("sub-agent stopped") }
+	if err != nil { return "", errors.New("sub-agent failed: " + err.Error()) }
+	if strings.TrimSpace(answer) == "" { return "", errors.New("sub-agent gave no summary") }
+	return answer, nil
+}
+
+// --- SERVEUR MCP (nanocode mcp) ---
+
+// MCPServedTools : outils proposés aux clients MCP, en plus de "agent".
+var MCPServedTools = []string{"read", "write", "edit", "glob", "bash"}
+
+// servedTools reprend les schémas du registre pour les outils exposés, au format MCP.
+func servedTools() []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, name := range MCPServedTools {
+		if t := registry.Lookup(name); t != nil {
+			out = append(out, map[string]interface{}{"name": name, "description": t.Description(), "inputSchema": t.Parameters()})
+		}
+	}
+	return append(out, map[string]interface{}{
+		"name":        "agent",
+		"description": "Hand a task to the nanocode agent. It works in this project with its own tools (read, edit, shell...) and returns its final answer",
+		"inputSchema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"prompt": map[string]string{"type": "string"}}, "required": []string{"prompt"}},
+	})
+}
+
+// serveMCP sert les outils sur stdin/stdout (JSON-RPC, un message par ligne). Les appels tournent en
+// parallèle et passent par les mêmes hooks, sandbox et post_write qu'en interactif.
+func serveMCP() {
+	out := os.Stdout
+	os.Stdout = os.Stderr // l'affichage habituel (stream, EXEC...) ne doit pas polluer le protocole
+	loadConfig()
+	registerTools()
+	if _, err := sandboxBackend(); err != nil { fmt.Printf("Warning: %v, shell commands will be refused.\n", err) }
+	startMCP()
+	defer killAllJobs()
+	defer bashShell.Close()
+	defer closeLSP()
+	defer closeMCP()
+
+	var writeMu, mu sync.Mutex
+	send := func(msg map[string]interface{}) {
+		msg["jsonrpc"] = "2.0"
+		b, _ := json.Marshal(msg)
+		writeMu.Lock()
+		out.Write(append(b, '\n'))
+		writeMu.Unlock()
+	}
+	running := map[string]context.CancelFunc{}
+	var wg sync.WaitGroup
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for sc.Scan() {
+		var msg mcp.Message
+		if json.Unmarshal(sc.Bytes(), &msg) != nil {
+			send(map[string]interface{}{"id": nil, "error": mcp.RPCError{Code: -32700, Message: "parse error"}})
+			continue
+		}
+		switch msg.Method {
+		case "initialize":
+			var p struct{ ProtocolVersion string `json:"protocolVersion"` }
+			json.Unmarshal(msg.Params, &p)
+			version := mcp.ProtocolVersion
+			if p.ProtocolVersion != "" && p.ProtocolVersion < version { version = p.ProtocolVersion }
+			send(map[string]interface{}{"id": msg.ID, "result": map[string]interface{}{
+				"protocolVersion": version,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]string{"name": "nanocode", "version": "7"},
+			}})
+		case "ping":
+			send(map[string]interface{}{"id": msg.ID, "result": map[string]interface{}{}})
+		case "tools/list":
+			send(map[string]interface{}{"id": msg.ID, "result": map[string]interface{}{"tools": servedTools()}})
+		case "tools/call":
+			ctx, cancel := context.WithCancel(context.Background())
+			mu.Lock()
+			running[string(msg.ID)] = cancel
+			mu.Unlock()
+			wg.Add(1)
+			go func(msg mcp.Message) {
+				defer wg.Done()
+				res := callServedTool(ctx, msg.Params)
+				mu.Lock()
+				delete(running, string(msg.ID))
+				mu.Unlock()
+				cancel()
+				send(map[string]interface{}{"id": msg.ID, "result": res})
+			}(msg)
+		case "notifications/cancelled":
+			var p struct{ RequestID json.RawMessage `json:"requestId"` }
+			json.Unmarshal(msg.Params, &p)
+			mu.Lock()
+			if cancel := running[string(p.RequestID)]; cancel != nil { cancel() }
+			mu.Unlock()
+		default:
+			if msg.Method != "" && msg.ID != nil {
+				send(map[string]interface{}{"id": msg.ID, "error": mcp.RPCError{Code: -32601, Message: "method not found: " + msg.Method}})
+			}
+		}
+	}
+	// stdin fermé : le client est parti, on arrête ce qui tourne encore
+	mu.Lock()
+	for _, cancel := range running { cancel() }
+	mu.Unlock()
+	wg.Wait()
+}
+
+func callServedTool(ctx context.Context, params json.RawMessage) map[string]interface{} {
+	var p struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	json.Unmarshal(params, &p)
+	var res string
+	var err error
+	switch {
+	case p.Name == "agent":
+		res, err = serveAgent(ctx, p.Arguments)
+		if err != nil { res = "Error: " + err.Error() }
+	case slices.Contains(MCPServedTools, p.Name):
+		res, err = execTool(ctx, p.Name, p.Arguments)
+	default:
+		err = errors.New("unknown tool " + p.Name)
+		res = "Error: " + err.Error()
+	}
+	return map[string]interface{}{"content": []map[string]string{{"type": "text", "text": res}}, "isError": err != nil}
+}
+
+// serveAgent lance une conversation neuve sur le prompt et renvoie la réponse finale du modèle. Chaque
+// appel est une session à part : hooks session_start/session_end, agents.md et contexte des hooks.
+func serveAgent(ctx context.Context, args map[string]interface{}) (string, error) {
+	prompt, _ := args["prompt"].(string)
+	if prompt == "" { return "", errors.New("prompt missing") }
+	if MistralKey == "" { return "", errors.New("MISTRAL_API_KEY missing on the nanocode side") }
+	cwd, _ := os.Getwd()
+	sess := &Session{Cwd: cwd}
+	sess.Start("mcp")
+	reason := "exit"
+	defer func() { sess.End(reason) }()
+	hook := runHooks(ctx, "user_prompt_submit", map[string]interface{}{"prompt": prompt})
+	if hook.Decision == "block" { return "", errors.New("blocked by hook: " + hook.Reason) }
+	if hook.Prompt != nil { prompt = *hook.Prompt }
+	if hook.Context != "" { prompt += "\n\n" + hook.Context }
+	sess.History = append(sess.History, Message{Role: "user", Content: mention.Expand(prompt, attachedNote)})
+	answer, err := sess.Turn(ctx)
+	if ctx.Err() != nil { reason = "interrupt" }
+	return answer, err
+}
+
+// --- MAIN ---
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mcp" { serveMCP(); return }
+	if MistralKey == "" { fmt.Printf("%sErreur: MISTRAL_API_KEY manquante.%s\n", Red, Reset); return }
+	
+	cwd, _ := os.Getwd()
+	loadConfig()
+	registerTools()
+	if backend, err := sandboxBackend(); err != nil {
+		fmt.Printf("%sWarning: %v, shell commands will be refused.%s\n", Yellow, err, Reset)
+	} else if backend != "" {
+		fmt.Printf("%sShell sandbox: %s (project writable, no network)%s\n", Dim, backend, Reset)
+	}
+	
+	fmt.Printf("%snanocode-v7 (Persistent Memory)%s | %s%s%s\n", Bold, Reset, Dim, CurrentModel, Reset)
+	fmt.Printf("Commands: %s/i%s (Init/Update Memory), %s/c%s (Clear Chat), %s/help%s (All Commands), %s/q%s (Quit)\n\n", Green, Reset, Green, Reset, Green, Reset, Green, Reset)
+
+	startMCP()
+	sess := &Session{Cwd: cwd}
+	sess.Start("startup")
+	loadCustomCommands()
+	defer killAllJobs()
+	defer bashShell.Close()
+	defer closeLSP()
+	defer closeMCP()
+	defer sess.End("exit")
+	intr.Listen(func() { killAllJobs(); bashShell.Close(); closeLSP(); closeMCP(); sess.End("interrupt") })
+	editor = newLineEditor(cwd)
+
+	for {
+		input, err := editor.ReadLine()
+		if err != nil { break }
+
+		name, _ := splitCommand(input)
+		if lookupCommand(input) != nil {
+			prompt, quit := runCommand(sess, input)
+			if quit { break }
+			if prompt == "" { continue }
+			input = prompt // commande perso : son gabarit part au modèle
+		} else if strings.HasPrefix(name, "/") && !strings.Contains(name[1:], "/") {
+			fmt.Printf("%sUnknown command %s (see /help)%s\n", Red, name, Reset)
+			continue
+		}
+
+		ctx, done := intr.Begin()
+		hook := runHooks(ctx, "user_prompt_submit", map[string]interface{}{"prompt": input})
+		if hook.Decision == "block" {
+			fmt.Printf("%sPrompt blocked by hook: %s%s\n", Yellow, hook.Reason, Reset)
+			done()
+			continue
+		}
+		if hook.Prompt != nil { input = *hook.Prompt }
+		if hook.Context != "" { input += "\n\n" + hook.Context }
+
+		sess.RefreshRepoMap()
+		sess.History = append(sess.History, Message{Role: "user", Content: mention.Expand(input, attachedNote)})
+
+		// --- BOUCLE ORCHESTRATEUR ---
+		if _, err := sess.Turn(ctx); err != nil && ctx.Err() == nil { fmt.Printf("%sError: %v%s\n", Red, err, Reset) }
+		done()
 		fmt.Println()
 	}
 }